@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseBudgetOverride parses a BUDGET command payload: "<watts>" or
+// "<watts> <duration>" (like "3000 2h") sets an override, while "", "off" or
+// "clear" clears it. A zero until means the override doesn't expire.
+func parseBudgetOverride(payload string, now time.Time) (budgetW int32, until time.Time, clear bool, err error) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 || strings.EqualFold(fields[0], "off") || strings.EqualFold(fields[0], "clear") {
+		return 0, time.Time{}, true, nil
+	}
+
+	if len(fields) > 2 {
+		return 0, time.Time{}, false, fmt.Errorf("expected \"<watts> [duration]\", got %q", payload)
+	}
+
+	w, err := strconv.ParseInt(fields[0], 10, 32)
+	if err != nil || w < 0 {
+		return 0, time.Time{}, false, fmt.Errorf("invalid budget %q", fields[0])
+	}
+
+	if len(fields) == 2 {
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return 0, time.Time{}, false, fmt.Errorf("invalid duration %q", fields[1])
+		}
+		until = now.Add(d)
+	}
+
+	return int32(w), until, false, nil
+}
+
+// parseSwitch parses an ENABLE command payload: "ON"/"OFF" as sent by Home
+// Assistant, or anything strconv.ParseBool accepts.
+func parseSwitch(payload string) (bool, error) {
+	payload = strings.TrimSpace(payload)
+	switch {
+	case strings.EqualFold(payload, "on"):
+		return true, nil
+	case strings.EqualFold(payload, "off"):
+		return false, nil
+	}
+
+	on, err := strconv.ParseBool(payload)
+	if err != nil {
+		return false, fmt.Errorf("expected ON or OFF, got %q", payload)
+	}
+	return on, nil
+}
+
+// parseBoost parses a BOOST command payload: a duration ("90m", "2h") or a
+// plain number of minutes. "", "off" and "0" cancel the boost.
+func parseBoost(payload string) (time.Duration, error) {
+	payload = strings.TrimSpace(payload)
+	if payload == "" || strings.EqualFold(payload, "off") {
+		return 0, nil
+	}
+
+	if minutes, err := strconv.Atoi(payload); err == nil {
+		if minutes < 0 {
+			return 0, fmt.Errorf("invalid boost duration %q", payload)
+		}
+		return time.Duration(minutes) * time.Minute, nil
+	}
+
+	d, err := time.ParseDuration(payload)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid boost duration %q", payload)
+	}
+	return d, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dailyEnergy turns lifetime energy totals into "today" values that reset at
+// local midnight. The totals at the start of the day are persisted to path so
+// a restart doesn't reset the counters.
+type dailyEnergy struct {
+	path string // Empty disables persistence
+	loc  *time.Location
+
+	lock      sync.Mutex
+	day       string             // "2006-01-02" in loc that baselines belong to
+	baselines map[string]float64 // Lifetime total (Wh) at the start of day, per counter
+}
+
+type dailyEnergyState struct {
+	Day       string             `json:"day"`
+	Baselines map[string]float64 `json:"baselines"`
+}
+
+func newDailyEnergy(path string, loc *time.Location) (*dailyEnergy, error) {
+	d := &dailyEnergy{
+		path:      path,
+		loc:       loc,
+		baselines: make(map[string]float64),
+	}
+
+	if path == "" {
+		return d, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state dailyEnergyState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	d.day = state.Day
+	if state.Baselines != nil {
+		d.baselines = state.Baselines
+	}
+	return d, nil
+}
+
+// Update records the lifetime total (Wh) of counter and returns the energy
+// since local midnight.
+func (d *dailyEnergy) Update(counter string, totalWh float64, now time.Time) (float64, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	changed := false
+	if day := now.In(d.loc).Format("2006-01-02"); day != d.day {
+		// First reading of a new day. Counters pick up a new baseline below.
+		d.day = day
+		d.baselines = make(map[string]float64)
+		changed = true
+	}
+
+	baseline, ok := d.baselines[counter]
+	if !ok || totalWh < baseline {
+		// Either the first reading today, or the device reset its lifetime total.
+		baseline = totalWh
+		d.baselines[counter] = baseline
+		changed = true
+	}
+
+	if changed {
+		if err := d.save(); err != nil {
+			return totalWh - baseline, err
+		}
+	}
+
+	return totalWh - baseline, nil
+}
+
+// save writes the baselines to a temp file first, so a crash never leaves a
+// truncated state file behind. Called with lock held.
+func (d *dailyEnergy) save() error {
+	if d.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(dailyEnergyState{Day: d.day, Baselines: d.baselines})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "math"
+
+// powerFlow is a derived view of where power is going, for custom dashboards.
+// Node values are signed: battery and grid are positive when supplying the
+// house and negative when absorbing power.
+type powerFlow struct {
+	SolarW   float64 `json:"solar_w"`
+	HouseW   float64 `json:"house_w"` // Load excluding the EV
+	EVW      float64 `json:"ev_w"`
+	BatteryW float64 `json:"battery_w"`
+	GridW    float64 `json:"grid_w"`
+
+	// Solar is assumed to serve the house first, then the EV, then the battery,
+	// with any remainder exported.
+	SolarToHouseW   float64 `json:"solar_to_house_w"`
+	SolarToEVW      float64 `json:"solar_to_ev_w"`
+	SolarToBatteryW float64 `json:"solar_to_battery_w"`
+	SolarToGridW    float64 `json:"solar_to_grid_w"`
+}
+
+func computePowerFlow(s *stateSnapshot) powerFlow {
+	evW := float64(s.EVSEMilliAmp) * float64(s.EVSEVolts) * float64(s.EVSEPhases) / 1000
+	f := powerFlow{
+		SolarW:   s.SolarW,
+		HouseW:   math.Max(0, s.LoadW-evW),
+		EVW:      evW,
+		BatteryW: s.ExportedBatteryW,
+		GridW:    -s.ExportedSolarW,
+	}
+
+	remaining := math.Max(0, s.SolarW)
+	take := func(want float64) float64 {
+		got := math.Min(remaining, math.Max(0, want))
+		remaining -= got
+		return got
+	}
+
+	f.SolarToHouseW = take(f.HouseW)
+	f.SolarToEVW = take(f.EVW)
+	f.SolarToBatteryW = take(-f.BatteryW)
+	f.SolarToGridW = remaining
+	return f
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// solarForecastClient fetches a production forecast from Forecast.Solar
+// (https://api.forecast.solar/estimate/:lat/:lon/:dec/:az/:kwp).
+type solarForecastClient struct {
+	client *http.Client
+	url    string
+}
+
+type forecastSolarResponse struct {
+	Result struct {
+		// Cumulative Wh produced during the day, keyed by local "2006-01-02 15:04:05"
+		WattHours map[string]float64 `json:"watt_hours"`
+		// Total Wh for each day, keyed by "2006-01-02"
+		WattHoursDay map[string]float64 `json:"watt_hours_day"`
+	} `json:"result"`
+}
+
+// GetRemainingTodayWh returns the forecast production between now and the end
+// of the day.
+func (c *solarForecastClient) GetRemainingTodayWh(now time.Time) (float64, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", c.url, resp.Status)
+	}
+
+	var forecast forecastSolarResponse
+	if err := json.NewDecoder(resp.Body).Decode(&forecast); err != nil {
+		return 0, err
+	}
+
+	return remainingTodayWh(&forecast, now)
+}
+
+func remainingTodayWh(forecast *forecastSolarResponse, now time.Time) (float64, error) {
+	dayTotal, ok := forecast.Result.WattHoursDay[now.Format("2006-01-02")]
+	if !ok {
+		return 0, fmt.Errorf("forecast has no entry for %s", now.Format("2006-01-02"))
+	}
+
+	// Find how much was expected to be produced so far today.
+	var producedWh float64
+	var latest time.Time
+	for ts, wh := range forecast.Result.WattHours {
+		t, err := time.ParseInLocation(time.DateTime, ts, now.Location())
+		if err != nil {
+			return 0, fmt.Errorf("parsing forecast time %q: %w", ts, err)
+		}
+
+		if t.YearDay() == now.YearDay() && t.Year() == now.Year() && !t.After(now) && t.After(latest) {
+			latest = t
+			producedWh = wh
+		}
+	}
+
+	if producedWh > dayTotal {
+		return 0, nil
+	}
+	return dayTotal - producedWh, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// kwCollector re-exports W and Wh gauges in kW and kWh, for dashboards that
+// expect those units. The values are read from the source gauges on every
+// scrape, so they never disagree with the originals.
+type kwCollector struct {
+	namespace string
+	sources   []kwSource
+}
+
+type kwSource struct {
+	gauge  *prometheus.GaugeVec
+	desc   *prometheus.Desc
+	labels []string
+}
+
+func newKWCollector(namespace string) *kwCollector {
+	return &kwCollector{namespace: namespace}
+}
+
+// add re-exports gauge, whose variable labels are labelNames, as name (like
+// "instantaneous_power_kw").
+func (c *kwCollector) add(gauge *prometheus.GaugeVec, name, help string, labelNames []string) {
+	c.sources = append(c.sources, kwSource{
+		gauge:  gauge,
+		desc:   prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", name), help, labelNames, nil),
+		labels: labelNames,
+	})
+}
+
+func (c *kwCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.sources {
+		ch <- s.desc
+	}
+}
+
+func (c *kwCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.sources {
+		metrics := make(chan prometheus.Metric)
+		go func(gauge *prometheus.GaugeVec) {
+			gauge.Collect(metrics)
+			close(metrics)
+		}(s.gauge)
+
+		for m := range metrics {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil || pb.Gauge == nil {
+				continue
+			}
+
+			byName := make(map[string]string)
+			for _, l := range pb.Label {
+				byName[l.GetName()] = l.GetValue()
+			}
+			values := make([]string, len(s.labels))
+			for i, name := range s.labels {
+				values[i] = byName[name]
+			}
+
+			ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, pb.Gauge.GetValue()/1000, values...)
+		}
+	}
+}
@@ -1,86 +1,74 @@
+// Command powerwall2mqtt polls a Tesla Powerwall gateway and EVSEs, exports
+// their readings to Prometheus and Home Assistant, and publishes a power budget
+// for EV charging.
+//
+// MQTT topics. The budget for the EVSE to follow and the Home Assistant state
+// are independent, and either can be turned off:
+//
+//	-grid-inverse-topic                    EV budget for the EVSE, formatted by -excess-scale
+//	                                       and -excess-invert. Not published if empty or with -dry-run
+//	<grid-inverse-topic>/<evse>            Each EVSE's share, with several EVSEs
+//	<ha-topic>/<entity>                    Home Assistant state, like ev_budget (plain W). Turn
+//	                                       entities off with -ha-disable
+//	<ha-topic>/<entity>/attributes         last_updated of each value, with -ha-last-updated
+//	<ha-topic>/availability                "online" or "offline" (last will)
+//	<ha-topic>/event/backup_reserve        Backup reserve changes made outside powerwall2mqtt
+//	<ha-topic>/selftest                    Written by -selftest
+//	<ha-discovery-prefix>/<component>/<ha-topic>/<entity>/config
+//	                                       Home Assistant discovery
+//	cmnd/<ha-topic>/<command>              Commands: POLL, SNAPSHOT, RELOGIN, BUDGET, BOOST, ENABLE
+//	-meters-raw-topic                      Raw meter aggregates, if set
+//	-price-topic, -ev-soc-topic            Read, if set
+//	-ev-charge-strategy-topic              Read and written, if set
 package main
 
 import (
-	"embed"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/anupcshan/powerwall2mqtt/powerwall"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const (
-	indexTmpl = `
-<!DOCTYPE html>
-<html>
-<head>
-	<script src="/assets/htmx.org@1.9.12/dist/htmx.min.js"></script>
-	<script src="/assets/htmx.org@1.9.12/dist/ext/sse.js"></script>
-	<style>
-	table, th, td {
-		border: 1px solid black;
-		border-collapse: collapse;
-		padding: 5px;
-		text-align: center;
-	}
-	</style>
-</head>
-<body>
-	<div hx-ext="sse" sse-connect="/events">
-		<div>Last updated: <span sse-swap="last-updated">Never</span></div><br/>
-		<table>
-			<tr>
-				<th>Solar</th>
-				<th>Load</th>
-				<th>Grid</th>
-				<th>Powerwall Level</th>
-				<th>Operation Mode</th>
-			</tr>
-			<tr>
-				<td sse-swap="solar">Pending</td>
-				<td sse-swap="load">Pending</td>
-				<td sse-swap="site">Pending</td>
-				<td sse-swap="powerwall-batt-level">Pending</td>
-				<td sse-swap="powerwall-oper-mode">Pending</td>
-			</tr>
-		</table>
-
-		<br/>
-
-		<div><b>EVSE:</b></div><br/>
-
-		<table>
-			<tr>
-				<th>Temp</th>
-				<th>Current</th>
-				<th>Power Budget</th>
-				<th>Strategy</th>
-				<th>EV</th>
-			</tr>
-			<tr>
-				<td sse-swap="evse-temp">Pending</td>
-				<td sse-swap="evse-current">Pending</td>
-				<td sse-swap="evse-budget">Pending</td>
-				<td sse-swap="evse-strategy">Pending</td>
-				<td sse-swap="ev-connected">Pending</td>
-			</tr>
-		</table>
-	</div>
-</body>
-</html>
-`
-)
+var labels = []string{"meter"}
 
-var (
-	labels = []string{"meter"}
-	//go:embed assets
-	assets embed.FS
-)
+// errPollingPaused marks poll cycles skipped by the circuit breaker.
+var errPollingPaused = errors.New("polling paused after repeated failures")
+
+const budgetPublishTimeout = 5 * time.Second
+
+// publishBudget publishes payload to topic, retrying once with at least QoS 1
+// if the initial publish fails or times out.
+func publishBudget(client mqtt.Client, topic string, qos byte, retained bool, payload string) error {
+	token := client.Publish(topic, qos, retained, payload)
+	if token.WaitTimeout(budgetPublishTimeout) && token.Error() == nil {
+		return nil
+	}
+
+	if qos < 1 {
+		qos = 1
+	}
+	log.Printf("Publishing to %s failed (%v), retrying with QoS %d", topic, token.Error(), qos)
+	token = client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(budgetPublishTimeout) {
+		return fmt.Errorf("timed out after %s", budgetPublishTimeout)
+	}
+	return token.Error()
+}
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.Ltime)
@@ -88,16 +76,107 @@ func main() {
 	powerwallIP := flag.String("powerwall-ip", "", "Powerwall IP")
 	password := flag.String("password", "", "Powerwall password")
 	pollingInterval := flag.Duration("poll-interval", 10*time.Second, "Polling interval")
+	pollJitter := flag.Duration("poll-jitter", 0, "Delay the first Powerwall and EVSE polls by a random time up to this, so instances started together don't poll in lockstep (must be less than -poll-interval)")
+	watchdogTimeout := flag.Duration("watchdog-timeout", 0, "Log all goroutine stacks and exit if a poll cycle doesn't complete for this long, so a supervisor can restart the process (0 to disable)")
+	evseInterval := flag.Duration("evse-interval", 0, "EVSE polling interval (0 to use -poll-interval)")
+	teslaUsername := flag.String("tesla-username", powerwall.DefaultTeslaUsername, "Powerwall gateway login username (like installer)")
+	teslaEmail := flag.String("tesla-email", powerwall.DefaultTeslaEmail, "Powerwall gateway login email")
+	teslaProxy := flag.String("tesla-proxy", "", "Proxy URL (like socks5://host:1080) for reaching the Powerwall gateway. Defaults to HTTP_PROXY/HTTPS_PROXY")
+	teslaTimeout := flag.Duration("tesla-timeout", 15*time.Second, "Timeout for each request to the Powerwall gateway")
+	teslaMaxBody := flag.Int64("tesla-max-body-bytes", powerwall.DefaultMaxBodyBytes, "Reject Powerwall gateway responses larger than this")
+	teslaMaxRPS := flag.Float64("tesla-max-rps", 2, "Maximum sustained requests per second to the Powerwall gateway (0 to disable)")
 	brokerURL := flag.String("broker", "", "Broker url (e.g., tcp://127.0.0.1:1883)")
-	gridPowerInverseTopic := flag.String("grid-inverse-topic", "powerwall/excess_power", "Topic to log inverse/negative of grid power to")
-	openEVSEAddr := flag.String("openevse", "", "OpenEVSE address (like 192.168.X.X or openevse.local)")
-	listen := flag.String("listen", ":9900", "Listen address for Prometheus handler")
+	gridPowerInverseTopic := flag.String("grid-inverse-topic", "powerwall/excess_power", "Topic the EV budget (W the EVSE may draw, the inverse of grid power) is published to for the EVSE to follow. Empty to only report it to Home Assistant (as ev_budget under -ha-topic)")
+	excessQoS := flag.Uint("excess-qos", 0, "MQTT QoS (0-2) for publishes to -grid-inverse-topic")
+	excessScale := flag.Float64("excess-scale", 1, "Multiply the budget published to -grid-inverse-topic by this (like 10 for deciwatts or 0.001 for kW)")
+	excessInvert := flag.Bool("excess-invert", false, "Negate the budget published to -grid-inverse-topic. The budget is already the inverse of grid power (positive while exporting), so this publishes it with the grid power sign")
+	excessRetain := flag.Bool("excess-retain", false, "Publish to -grid-inverse-topic with the retain flag, so late subscribers get the last budget")
+	openEVSEAddr := flag.String("openevse", "", "Comma separated EVSE addresses (like 192.168.X.X or openevse.local). With several EVSEs, each one's share of the budget is also published on <grid-inverse-topic>/ev, <grid-inverse-topic>/ev2 and so on")
+	openEVSEURL := flag.String("openevse-url", "", "Like -openevse, but with full base URLs (like https://proxy.local/openevse) for EVSEs behind HTTPS or a reverse proxy")
+	evseType := flag.String("evse-type", "openevse", "EVSE backend at the -openevse addresses: openevse or go-e")
+	gridMeterURL := flag.String("grid-meter-url", "", "Shelly EM status URL (like http://192.168.X.X/status) to use for grid power instead of the Powerwall site meter")
+	gridMeterChannel := flag.Int("grid-meter-channel", 0, "Shelly EM channel measuring grid power")
+	gridServicesReserve := flag.Float64("grid-services-reserve-percent", -1, "Set the Powerwall backup reserve (%) while a grid services (VPP) event is active, restoring it afterwards (negative to leave it alone)")
+	gridServicesModeFlag := flag.String("grid-services-mode", "", "Set the Powerwall operation mode (self_consumption, autonomous or backup) while a grid services event is active, restoring it afterwards (empty to leave it alone)")
+	gridServicesCooldown := flag.Duration("grid-services-cooldown", 0, "Keep EV charging off for this long after a grid services (VPP) event ends")
+	priceTopic := flag.String("price-topic", "", "MQTT topic publishing the current electricity price (plain number), used by the price strategy")
+	priceThreshold := flag.Float64("price-threshold", 0.15, "In price strategy, charge at full speed while the price is below this")
+	priceMaxAge := flag.Duration("price-max-age", 2*time.Hour, "In price strategy, fall back to the off-peak window if no price arrives for this long")
+	evSOCTopic := flag.String("ev-soc-topic", "", "MQTT topic publishing the EV state of charge (plain number, %)")
+	evTargetSOC := flag.Float64("ev-target-soc", 100, "Stop EV charging once the state of charge from -ev-soc-topic reaches this (%)")
+	batteryTargetPercent := flag.Float64("battery-target-percent", 80, "In batterytarget strategy, Powerwall level (%) to reach from solar before charging the EV")
+	batteryTargetHysteresis := flag.Float64("battery-target-hysteresis", 5, "In batterytarget strategy, how far (%) below the target the Powerwall may drop before solar goes back to it")
+	solarForecastURL := flag.String("solar-forecast-url", "", "Forecast.Solar estimate URL (like https://api.forecast.solar/estimate/LAT/LON/DEC/AZ/KWP). Lets batterytarget give the EV solar early when enough is forecast to fill the Powerwall later")
+	solarForecastInterval := flag.Duration("solar-forecast-interval", 30*time.Minute, "How often to refresh the solar forecast")
+	meterStaleAfter := flag.Duration("meter-stale-after", time.Minute, "Pause EV charging if Powerwall meter readings are missing for longer than this (0 to disable)")
+	breakerFailures := flag.Int("tesla-breaker-failures", 0, "Pause polling the Powerwall after this many consecutive failed poll cycles (0 to never pause)")
+	breakerCooldown := flag.Duration("tesla-breaker-cooldown", 5*time.Minute, "While polling is paused, try a single poll cycle this often")
+	maxDataAge := flag.Duration("max-data-age", 2*time.Minute, "If no Powerwall poll succeeds for this long, hold the EV budget at -stale-budget-w (0 to disable)")
+	batteryProtectDischargeW := flag.Float64("battery-protect-discharge-w", 0, "Stop EV charging during peak hours once the Powerwall has discharged more than this (W) for -battery-protect-duration, until it has been below it for as long again (0 to disable)")
+	batteryProtectDuration := flag.Duration("battery-protect-duration", 10*time.Minute, "How long discharge must stay above (or below) -battery-protect-discharge-w to start (or end) battery protection")
+	batteryProtectReserve := flag.Float64("battery-protect-reserve-percent", -1, "Raise the Powerwall backup reserve (%) to this while battery protection is active, restoring it afterwards (negative to leave it alone)")
+	batteryIdleDeadband := flag.Float64("battery-idle-deadband", 50, "Powerwall power (W) within this much of zero is reported as idle rather than charging or discharging")
+	reserveMargin := flag.Float64("reserve-margin-percent", -1, "Stop EV charging while the Powerwall is at or below its backup reserve plus this many percent (negative to disable)")
+	reserveMarginAll := flag.Bool("reserve-margin-all-strategies", false, "Apply -reserve-margin-percent to the fullspeed, offpeak and price strategies too")
+	exportWindow := flag.String("export-window", "", "Daily window (HH:MM-HH:MM, local time) during which the EV never charges, whatever the strategy, like while exports earn premium credits (empty to disable)")
+	phaseMaxAmps := flag.Float64("phase-max-amps", 0, "On a three phase supply, keep the most loaded phase of the load meter under this current (A), like the main breaker rating. The EV is then taken to charge from all three phases. 0 means a single phase supply")
+	tempInterpolate := flag.Bool("temp-derate-interpolate", false, "Lower the EVSE current gradually as it heats up, instead of in steps at each temperature threshold")
+	zeroWhenDisconnected := flag.Bool("ev-disconnect-zero-budget", true, "Drop the EV budget to 0 as soon as the EVSE reports the EV unplugged")
+	staleBudgetW := flag.Int("stale-budget-w", 0, "EV budget (W) to apply while Powerwall data is stale")
+	strategyRampDown := flag.Duration("strategy-ramp-down", 0, "When a strategy change lowers the EV budget, ramp down to it over this long (0 to switch immediately)")
+	strategyRampUp := flag.Duration("strategy-ramp-up", 0, "When a strategy change raises the EV budget, ramp up to it over this long (0 to switch immediately)")
+	solarStartDelay := flag.Duration("solar-start-delay", 0, "Only start charging from solar once the solar budget has been above the minimum charge rate for this long")
+	solarStopDelay := flag.Duration("solar-stop-delay", 0, "Keep charging at the minimum rate until the solar budget has been below it for this long, then stop")
+	solarCooldown := flag.Duration("solar-restart-cooldown", 0, "After charging from solar stops, wait at least this long before starting again")
+	startupGrace := flag.Duration("startup-grace", 0, "After starting, don't change the EV budget for this long unless all Powerwall readings and the strategy have arrived before then")
+	softStartRateW := flag.Float64("soft-start-rate-w", 0, "When the EV budget rises from 0, let it grow by at most this many W per second for -soft-start-duration (0 to disable)")
+	softStartDuration := flag.Duration("soft-start-duration", 30*time.Second, "How long -soft-start-rate-w applies after charging starts")
+	timezone := flag.String("timezone", "Local", "IANA time zone (like America/Los_Angeles) of the peak and export windows, and whose midnight resets the daily energy counters")
+	stateFile := flag.String("state-file", "", "File to keep the daily energy counters in across restarts (empty to start from zero on every restart)")
+	listen := flag.String("listen", ":9900", "Listen address for the web UI (and Prometheus handler, unless -metrics-listen is set)")
+	webPassword := flag.String("web-password", "", "Password (HTTP basic auth, any username) for live edits on the /config page and POST /mqtt/reset. Both are disabled if empty")
+	noWeb := flag.Bool("no-web", false, "Disable the web UI and its endpoints, serving only /metrics")
+	tlsCert := flag.String("tls-cert", "", "Serve the web UI and metrics over HTTPS with this certificate (PEM). Plain HTTP if empty")
+	tlsKey := flag.String("tls-key", "", "Private key (PEM) for -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "If set, require HTTPS clients to present a certificate signed by a CA in this file (PEM)")
+	metricsListen := flag.String("metrics-listen", "", "If set, serve /metrics on this address instead of -listen")
+	disableMeters := flag.String("disable-meters", "", "Comma separated Powerwall meters (like battery,busway) to not export to Prometheus")
+	metricsKW := flag.Bool("metrics-kw", false, "Also export the power and energy metrics in kW and kWh, with a _kw or _kwh suffix")
+	metricsNamespace := flag.String("metrics-namespace", "energy", "Namespace (name prefix) for all exported Prometheus metrics")
+	siteName := flag.String("site-name", "", "If set, added as a constant site label to all exported metrics")
 	debug := flag.Bool("debug", false, "Print debug logs")
 	dryRun := flag.Bool("dry-run", true, "Dry run mode (disable any writes in dry run mode)")
 	evChargeStrategyTopic := flag.String("ev-charge-strategy-topic", "", "MQTT topic to read/write the current charge strategy")
+	mqttKeepAlive := flag.Duration("mqtt-keepalive", 30*time.Second, "MQTT keepalive interval")
+	mqttConnectTimeout := flag.Duration("mqtt-connect-timeout", 10*time.Second, "Timeout for establishing a connection to the MQTT broker")
+	mqttConnectRetries := flag.Int("mqtt-connect-retries", 5, "Number of times to retry the initial MQTT connect (with backoff) before giving up")
+	haTopic := flag.String("ha-topic", "powerwall2mqtt", "Base MQTT topic for Home Assistant sensor state and commands. Independent of -grid-inverse-topic")
+	haDiscoveryPrefix := flag.String("ha-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	haLastUpdated := flag.Bool("ha-last-updated", false, "Publish when each value was last read, as a last_updated attribute of its Home Assistant entity (doubles the MQTT message rate)")
+	metersRawTopic := flag.String("meters-raw-topic", "", "If set, publish the raw /api/meters/aggregates JSON here (retained) on every poll")
+	metersRawQoS := flag.Uint("meters-raw-qos", 0, "MQTT QoS (0-2) for publishes to -meters-raw-topic")
+	availabilityHeartbeat := flag.Duration("availability-heartbeat", 0, "If set, re-publish availability and all sensor values at least this often, and have Home Assistant mark them unavailable after 3 missed heartbeats (0 to disable)")
+	haNamePrefix := flag.String("ha-name-prefix", "", "Prefix for the friendly name of every Home Assistant entity (like \"Garage \")")
+	haMinIntervalsFlag := flag.String("ha-min-intervals", "", "Comma separated minimum time between MQTT publishes of a changed value, by entity id (like solar_power=30s,load_power=30s)")
+	tempPrecision := flag.Int("temp-precision", 1, "Decimals in temperatures published to MQTT")
+	powerPrecision := flag.Int("power-precision", 0, "Decimals in powers (W) published to MQTT")
+	haEVTracker := flag.Bool("ha-ev-tracker", false, "Also register the EV as a Home Assistant device_tracker, home while plugged in")
+	haDisableFlag := flag.String("ha-disable", "", "Comma separated Home Assistant entity ids (like evse_temperature,battery_export) to neither register nor publish")
+	haIconsFlag := flag.String("ha-icons", "", "Comma separated Home Assistant icons by entity id (like ev_budget=mdi:ev-station,ev_connected=mdi:car-electric)")
+	solarFloorW := flag.Float64("solar-floor-w", 0, "In solar mode, size EV budget from gross solar production (minus -baseline-load-w) when it exceeds this value (0 to disable)")
+	baselineLoadW := flag.Float64("baseline-load-w", 500, "Assumed house load subtracted from gross solar production when -solar-floor-w is in effect")
+	selfTestAndExit := flag.Bool("selftest", false, "Log in to the Powerwall and poll it once, connect and publish to the MQTT broker, print a pass/fail report and exit (nonzero on failure)")
+	dumpConfigAndExit := flag.Bool("dump-config", false, "Print the effective configuration (secrets redacted) as JSON and exit")
 
 	flag.Parse()
 
+	if *dumpConfigAndExit {
+		if err := dumpConfig(os.Stdout, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *powerwallIP == "" {
 		log.Fatal("Powerwall IP not provided")
 	}
@@ -106,192 +185,816 @@ func main() {
 		log.Fatal("Broker URL not provided")
 	}
 
+	haIcons, err := powerwall.ParseHAIcons(*haIconsFlag)
+	if err != nil {
+		log.Fatalf("Invalid -ha-icons: %v", err)
+	}
+	haMinIntervals, err := powerwall.ParseHAMinIntervals(*haMinIntervalsFlag)
+	if err != nil {
+		log.Fatalf("Invalid -ha-min-intervals: %v", err)
+	}
+	haDisabled, err := powerwall.ParseHADisabled(*haDisableFlag)
+	if err != nil {
+		log.Fatalf("Invalid -ha-disable: %v", err)
+	}
+	if !*haEVTracker {
+		haDisabled["ev_tracker"] = true
+	}
+
+	if *teslaUsername == "" || *teslaEmail == "" {
+		log.Fatal("-tesla-username and -tesla-email must not be empty")
+	}
+
+	if *excessQoS > 2 {
+		log.Fatalf("Invalid -excess-qos %d: must be 0, 1 or 2", *excessQoS)
+	}
+	if *gridPowerInverseTopic == "" {
+		log.Printf("No -grid-inverse-topic, the EV budget is only reported to Home Assistant")
+	}
+
+	if *metersRawQoS > 2 {
+		log.Fatalf("Invalid -meters-raw-qos %d: must be 0, 1 or 2", *metersRawQoS)
+	}
+
 	batteryLevelGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "battery_percentage",
 		Help:      "Battery level percentage (0-100)",
 	}, labels)
 
 	currentGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "instantaneous_current",
 		Help:      "Instantaneous current of individual CT clamps (A)",
 	}, labels)
 
 	energyExportedGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "energy_exported",
 		Help:      "Total energy exported from individual meters (Wh)",
 	}, labels)
 
 	energyImportedGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "energy_imported",
 		Help:      "Total energy imported from individual meters (Wh)",
 	}, labels)
 
 	energyLevelGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "energy_level",
 		Help:      "Energy levels for individual meters (Wh)",
 	}, labels)
 
 	powerGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "instantaneous_power",
 		Help:      "Instantaneous power of individual CT clamps (W)",
 	}, labels)
 
+	loadPhaseCurrentGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "load_phase_current",
+		Help:      "Current (A) on each phase of the Powerwall load meter",
+	}, []string{"phase"})
+
 	tempGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "temp",
 		Help:      "Temperature sensor reading (°C)",
 	}, labels)
 
+	voltageGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "voltage",
+		Help:      "Voltage measured by individual meters (V)",
+	}, labels)
+
+	powerFactorGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "power_factor",
+		Help:      "Power factor (real power / apparent power) of individual meters",
+	}, labels)
+
+	estimatedGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "estimated",
+		Help:      "1 if the named derived value is an estimate rather than computed from measurements",
+	}, labels)
+
 	connectedGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "connected",
 		Help:      "Is entity (ev, mqtt, etc) connected (1 for yes, 0 otherwise)",
 	}, labels)
 
 	gridServicesEnabledGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "energy",
+		Namespace: *metricsNamespace,
 		Name:      "grid_services_enabled",
 		Help:      "Is Powerwall feeding grid in VPP event?",
 	}, labels)
 
-	prometheus.MustRegister(
+	mqttReconnectsCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Name:      "mqtt_reconnects_total",
+		Help:      "Number of times the MQTT connection was re-established after being lost",
+	})
+
+	solarForecastGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "solar_forecast_remaining_wh",
+		Help:      "Forecast solar production for the rest of today (Wh)",
+	})
+
+	dataStaleGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "data_stale",
+		Help:      "1 if no Powerwall poll has succeeded within -max-data-age and EV control is paused",
+	})
+
+	evseMaxCurrentGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "evse_max_current",
+		Help:      "Max current (A) configured on the EVSEs (summed), which caps the EV budget. The built in limit if not reported",
+	})
+
+	evseCurrentGapGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "evse_current_gap",
+		Help:      "Current (A) the EV budget offers minus what the EVSEs draw. Stays high when the car doesn't take the offered power",
+	})
+
+	tempMaxAmpsGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "evse_temp_max_amps",
+		Help:      "EVSE current limit (A) derived from its temperature",
+	})
+
+	batteryStateGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "battery_state",
+		Help:      "1 for the Powerwall's current state (charging, discharging or idle), 0 for the others",
+	}, []string{"state"})
+
+	offPeakGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "off_peak",
+		Help:      "1 outside the peak rates window",
+	})
+
+	gridServicesActiveGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "grid_services_active_today_seconds",
+		Help:      "How long grid services (VPP) events have been active since local midnight",
+	})
+
+	gridServicesEventsGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "grid_services_events_today",
+		Help:      "Number of grid services (VPP) events since local midnight",
+	})
+
+	currentLimitGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "current_limit",
+		Help:      "Min and max current configured on individual EVSEs (A)",
+	}, labels)
+
+	divertModeGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "evse_divert_mode",
+		Help:      "OpenEVSE charge mode: 1 normal (ignores the EV budget), 2 eco",
+	}, labels)
+
+	pilotGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "evse_pilot",
+		Help:      "Current offered to the car by individual EVSEs (A), while a car is connected",
+	}, labels)
+
+	pilotMismatchGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "evse_pilot_mismatch",
+		Help:      "Pilot current minus the current drawn (A) on individual EVSEs. Stays high while the car limits its own charge rate",
+	}, labels)
+
+	lastLoginGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "tesla_last_login_timestamp_seconds",
+		Help:      "Unix time of the last login attempt to the Powerwall gateway",
+	})
+
+	loginSuccessGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "tesla_last_login_success",
+		Help:      "1 if the last login attempt to the Powerwall gateway succeeded",
+	})
+
+	gatewayInfoGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "gateway_info",
+		Help:      "Always 1. Labels identify the Powerwall gateway's firmware",
+	}, []string{"version", "git_hash", "device_type"})
+
+	teslaReachableGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "tesla_reachable",
+		Help:      "0 while polling the Powerwall gateway is paused after repeated failures",
+	})
+
+	consecutiveFailuresGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "consecutive_poll_failures",
+		Help:      "Number of Powerwall poll cycles that failed in a row. Cycles skipped while polling is paused don't count",
+	})
+
+	mqttQueueDepthGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "mqtt_queue_depth",
+		Help:      "Number of MQTT state updates waiting to be published",
+	})
+
+	mqttDroppedCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Name:      "mqtt_dropped_total",
+		Help:      "Number of MQTT state updates dropped because the publish queue was full",
+	})
+
+	energyTodayGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: *metricsNamespace,
+		Name:      "energy_today",
+		Help:      "Energy since local midnight for individual meters (Wh)",
+	}, labels)
+
+	budgetPublishFailuresCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: *metricsNamespace,
+		Name:      "ev_budget_publish_failures_total",
+		Help:      "Number of times publishing the EV power budget to MQTT failed (after retry)",
+	})
+
+	selfStats := newSelfCollector(*metricsNamespace)
+
+	kwMetrics := newKWCollector(*metricsNamespace)
+	kwMetrics.add(powerGauge, "instantaneous_power_kw", "Instantaneous power of individual CT clamps (kW)", labels)
+	kwMetrics.add(energyExportedGauge, "energy_exported_kwh", "Total energy exported from individual meters (kWh)", labels)
+	kwMetrics.add(energyImportedGauge, "energy_imported_kwh", "Total energy imported from individual meters (kWh)", labels)
+	kwMetrics.add(energyLevelGauge, "energy_level_kwh", "Energy levels for individual meters (kWh)", labels)
+	kwMetrics.add(energyTodayGauge, "energy_today_kwh", "Energy since local midnight for individual meters (kWh)", labels)
+
+	// With -site-name, every series gets a constant site label so multiple
+	// installations can be scraped into the same Prometheus.
+	registerer := prometheus.DefaultRegisterer
+	if *siteName != "" {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"site": *siteName}, registerer)
+	}
+
+	registerer.MustRegister(
 		batteryLevelGauge,
 		currentGauge,
 		energyExportedGauge,
 		energyImportedGauge,
 		energyLevelGauge,
 		powerGauge,
+		loadPhaseCurrentGauge,
 		tempGauge,
 		connectedGauge,
+		voltageGauge,
+		powerFactorGauge,
+		estimatedGauge,
 		gridServicesEnabledGauge,
+		mqttReconnectsCounter,
+		budgetPublishFailuresCounter,
+		dataStaleGauge,
+		solarForecastGauge,
+		energyTodayGauge,
+		mqttQueueDepthGauge,
+		mqttDroppedCounter,
+		tempMaxAmpsGauge,
+		evseMaxCurrentGauge,
+		evseCurrentGapGauge,
+		lastLoginGauge,
+		loginSuccessGauge,
+		teslaReachableGauge,
+		gatewayInfoGauge,
+		consecutiveFailuresGauge,
+		currentLimitGauge,
+		divertModeGauge,
+		pilotGauge,
+		pilotMismatchGauge,
+		gridServicesActiveGauge,
+		gridServicesEventsGauge,
+		selfStats,
+		offPeakGauge,
+		batteryStateGauge,
 	)
+	if *metricsKW {
+		registerer.MustRegister(kwMetrics)
+	}
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("Invalid -timezone: %v", err)
+	}
 
-	teslaClient := NewTEGClient(*powerwallIP, *password, *debug, batteryLevelGauge, energyExportedGauge, energyImportedGauge, energyLevelGauge, powerGauge, gridServicesEnabledGauge)
-	if err := teslaClient.Login(); err != nil {
+	daily, err := newDailyEnergy(*stateFile, loc)
+	if err != nil {
+		log.Fatalf("Error loading %s: %v", *stateFile, err)
+	}
+
+	// updateDaily publishes the energy since midnight for counter, given its
+	// lifetime total.
+	updateDaily := func(counter string, totalWh float64, report func(float64)) {
+		wh, err := daily.Update(counter, totalWh, time.Now())
+		if err != nil {
+			log.Printf("Error saving daily energy counters: %v", err)
+		}
+		energyTodayGauge.WithLabelValues(counter).Set(wh)
+		report(wh)
+	}
+
+	teslaClient := powerwall.NewTEGClient(*powerwallIP, *password, *debug, batteryLevelGauge, energyExportedGauge, energyImportedGauge, energyLevelGauge, powerGauge, gridServicesEnabledGauge)
+	// Allow a full poll cycle to go through without waiting.
+	teslaClient.Limiter = powerwall.NewRateLimiter(*teslaMaxRPS, 10)
+	teslaClient.Timeout = *teslaTimeout
+	teslaClient.MaxBodyBytes = *teslaMaxBody
+	teslaClient.Username = *teslaUsername
+	teslaClient.Email = *teslaEmail
+	if *teslaProxy != "" {
+		proxy, err := url.Parse(*teslaProxy)
+		if err != nil {
+			log.Fatalf("Invalid -tesla-proxy: %v", err)
+		}
+		teslaClient.Proxy = proxy
+	}
+	teslaClient.DisabledMeters = make(map[string]bool)
+	for _, meter := range strings.Split(*disableMeters, ",") {
+		if meter = strings.TrimSpace(meter); meter == "" {
+			continue
+		}
+		if !powerwall.IsKnownMeter(meter) {
+			log.Printf("Warning: -disable-meters: unknown meter %q (known meters: %s)", meter, strings.Join(powerwall.KnownMeters, ", "))
+		}
+		teslaClient.DisabledMeters[meter] = true
+	}
+
+	if *selfTestAndExit {
+		if !runSelfTest(os.Stdout, teslaClient, *brokerURL, *mqttConnectTimeout, *haTopic) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// login (re)authenticates with the gateway and records the outcome.
+	login := func() error {
+		err := teslaClient.Login()
+		lastLoginGauge.SetToCurrentTime()
+		if err != nil {
+			loginSuccessGauge.Set(0)
+		} else {
+			loginSuccessGauge.Set(1)
+		}
+		return err
+	}
+
+	if err := login(); err != nil {
 		log.Fatal(err)
 	}
 
+	// Only used for information, so older firmware without it isn't fatal.
+	gatewayStatus, err := teslaClient.GetGatewayStatus()
+	if err != nil {
+		log.Printf("Error getting gateway status: %v", err)
+		gatewayStatus = &powerwall.GatewayStatus{}
+	} else {
+		uptime, _ := gatewayStatus.Uptime()
+		log.Printf("Gateway %s firmware %s (%s), up %s", gatewayStatus.DeviceType, gatewayStatus.Version, gatewayStatus.GitHash, uptime.Round(time.Second))
+		gatewayInfoGauge.WithLabelValues(gatewayStatus.Version, gatewayStatus.GitHash, gatewayStatus.DeviceType).Set(1)
+	}
+
+	var reporter *powerwall.MQTTReporter
+	var mqttConnectedOnce atomic.Bool
 	mqttClient := mqtt.NewClient(
 		mqtt.NewClientOptions().
 			AddBroker(*brokerURL).
-			SetAutoReconnect(true),
+			SetAutoReconnect(true).
+			SetKeepAlive(*mqttKeepAlive).
+			SetConnectTimeout(*mqttConnectTimeout).
+			SetMaxReconnectInterval(time.Minute).
+			SetWill(powerwall.AvailabilityTopic(*haTopic), "offline", 1, true).
+			SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+				log.Printf("Lost connection to MQTT broker: %v", err)
+			}).
+			SetOnConnectHandler(func(_ mqtt.Client) {
+				if mqttConnectedOnce.Swap(true) {
+					log.Printf("Reconnected to MQTT broker")
+					mqttReconnectsCounter.Inc()
+				}
+				reporter.OnConnect()
+			}),
 	)
+	reporter = powerwall.NewMQTTReporter(mqttClient, *haTopic, *haDiscoveryPrefix)
+	reporter.HeartbeatInterval = *availabilityHeartbeat
+	reporter.NamePrefix = *haNamePrefix
+	reporter.LastUpdated = *haLastUpdated
+	reporter.Icons = haIcons
+	reporter.MinIntervals = haMinIntervals
+	reporter.Disabled = haDisabled
+	reporter.TempPrecision = *tempPrecision
+	reporter.PowerPrecision = *powerPrecision
+	reporter.SWVersion = gatewayStatus.Version
+	reporter.QueueDepthGauge = mqttQueueDepthGauge
+	reporter.DroppedCounter = mqttDroppedCounter
 
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Error connecting to MQTT: %s", token.Error())
+	// Auto-reconnect only kicks in after the first successful connect, so retry
+	// the initial connect here in case the broker is briefly unavailable.
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		var err error
+		if token := mqttClient.Connect(); !token.WaitTimeout(*mqttConnectTimeout) {
+			err = fmt.Errorf("timed out after %s", *mqttConnectTimeout)
+		} else {
+			err = token.Error()
+		}
+
+		if err == nil {
+			break
+		}
+
+		if attempt >= *mqttConnectRetries {
+			log.Fatalf("Error connecting to MQTT broker %s: %v", *brokerURL, err)
+		}
+
+		log.Printf("Error connecting to MQTT broker %s (attempt %d of %d): %v. Retrying in %s", *brokerURL, attempt+1, *mqttConnectRetries+1, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
 	}
 
-	ticker := time.NewTicker(*pollingInterval)
+	go reporter.PublishLoop()
 
-	var evseClient *openEVSEClient
-	if *openEVSEAddr != "" {
-		evseClient = &openEVSEClient{
-			// Nearly all requests should complete in <100ms.
-			client:              &http.Client{Timeout: 2 * time.Second},
-			openEVSEAddr:        *openEVSEAddr,
-			currentGauge:        currentGauge,
-			energyImportedGauge: energyImportedGauge,
-			powerGauge:          powerGauge,
-			tempGauge:           tempGauge,
-			connectedGauge:      connectedGauge,
+	if *pollJitter < 0 || *pollJitter >= *pollingInterval {
+		log.Fatal("-poll-jitter must be less than -poll-interval")
+	}
+	// Seeded explicitly: every instance needs its own offsets. Only used from
+	// this goroutine.
+	jitterRand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pollOffset := func() time.Duration {
+		if *pollJitter <= 0 {
+			return 0
 		}
+		return time.Duration(jitterRand.Int63n(int64(*pollJitter)))
 	}
 
-	var latestEVBudget int32
-	cont := NewController(
+	// The first EVSE keeps the "ev" label it had before multiple EVSEs were
+	// supported. Others are "ev2", "ev3" and so on.
+	var evseClients []powerwall.EVSEClient
+	var evseNames []string
+	evseURLs, err := powerwall.EVSEBaseURLs(*openEVSEAddr, *openEVSEURL)
+	if err != nil {
+		log.Fatalf("Invalid EVSE address: %v", err)
+	}
+	evsePhases := 1
+	if *phaseMaxAmps > 0 {
+		evsePhases = 3
+	}
+	for i, baseURL := range evseURLs {
+		name := "ev"
+		if i > 0 {
+			name = fmt.Sprintf("ev%d", i+1)
+		}
+
+		gauges := powerwall.EVSEGauges{
+			Label:               name,
+			Phases:              evsePhases,
+			CurrentGauge:        currentGauge,
+			EnergyImportedGauge: energyImportedGauge,
+			PowerGauge:          powerGauge,
+			TempGauge:           tempGauge,
+			ConnectedGauge:      connectedGauge,
+			VoltageGauge:        voltageGauge,
+			PowerFactorGauge:    powerFactorGauge,
+			EstimatedGauge:      estimatedGauge,
+			CurrentLimitGauge:   currentLimitGauge,
+			DivertModeGauge:     divertModeGauge,
+			PilotGauge:          pilotGauge,
+			PilotMismatchGauge:  pilotMismatchGauge,
+		}
+		// Nearly all requests should complete in <100ms.
+		httpClient := &http.Client{Timeout: 2 * time.Second}
+
+		var evseClient powerwall.EVSEClient
+		switch *evseType {
+		case "openevse":
+			evseClient = powerwall.NewOpenEVSEClient(gauges, httpClient, baseURL)
+		case "go-e":
+			evseClient = powerwall.NewGoEChargerClient(gauges, httpClient, baseURL)
+		default:
+			log.Fatalf("Unknown EVSE type %q (expected openevse or go-e)", *evseType)
+		}
+		evseClients = append(evseClients, evseClient)
+		evseNames = append(evseNames, name)
+	}
+	fleet := powerwall.NewEVSEFleet(evseNames)
+	fleet.TempInterpolate = *tempInterpolate
+	fleet.ThreePhase = evsePhases == 3
+
+	var gridMeter *powerwall.ShellyEMClient
+	if *gridMeterURL != "" {
+		gridMeter = powerwall.NewShellyEMClient(&http.Client{Timeout: 2 * time.Second}, *gridMeterURL, *gridMeterChannel, powerGauge)
+	}
+
+	// formatBudget applies -excess-scale and -excess-invert for consumers that
+	// expect different units or sign.
+	formatBudget := func(budgetW int32) string {
+		v := float64(budgetW) * *excessScale
+		if *excessInvert {
+			v = -v
+		}
+		// Round away float noise like 0.7000000000000001 from 7 * 0.1.
+		return strconv.FormatFloat(math.Round(v*1e6)/1e6, 'f', -1, 64)
+	}
+
+	snapshots := newSnapshotStore()
+	cont := powerwall.NewController(
 		func(limit int32) error {
-			atomic.StoreInt32(&latestEVBudget, limit)
 			if *dryRun {
 				log.Printf("[DRY RUN] Setting eco power limit to %d", limit)
+				if len(evseClients) > 1 {
+					log.Printf("[DRY RUN] Splitting eco power limit between %v as %v", evseNames, fleet.Split(limit))
+				}
+				return nil
+			}
+			if *gridPowerInverseTopic == "" {
+				// The budget is only reported to Home Assistant.
 				return nil
-			} else {
-				token := mqttClient.Publish(*gridPowerInverseTopic, 0, false, fmt.Sprintf("%d", limit))
-				_ = token.Wait()
-				return token.Error()
 			}
-		},
-	)
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/assets/", http.FileServer(http.FS(assets)))
-	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, indexTmpl)
-	}))
-
-	var controllerStrategy atomic.Value
-	controllerStrategy.Store("")
-
-	http.Handle("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/event-stream")
-
-		dataCache := make(map[string]string)
-
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
-
-		for {
-			data := map[string]string{
-				"solar":                fmt.Sprintf("%.0f W", cont.GetSolarW()),
-				"load":                 fmt.Sprintf("%.0f W", cont.GetLoadW()),
-				"site":                 fmt.Sprintf("%.0f W", -cont.GetExportedSolarW()),
-				"powerwall-batt-level": fmt.Sprintf("%.1f%%", cont.GetPowerwallBatteryLevel()),
-				"powerwall-oper-mode":  cont.GetOperationMode().String(),
-				"evse-temp":            cont.GetEVSETemp().String(),
-				"evse-current":         fmt.Sprintf("%.1f A", float64(cont.GetEVSECurrent())/1000.0),
-				"evse-budget":          fmt.Sprintf("%d W", atomic.LoadInt32(&latestEVBudget)),
-				"evse-strategy":        controllerStrategy.Load().(string),
-				"ev-connected":         cont.GetEVConnected().String(),
-				"last-updated":         time.Now().Format(time.DateTime),
+			if err := publishBudget(mqttClient, *gridPowerInverseTopic, byte(*excessQoS), *excessRetain, formatBudget(limit)); err != nil {
+				// A transient broker problem must not take down the control loop.
+				// The budget is published again on the next sensor change.
+				log.Printf("Error publishing EV budget %d to %s: %v", limit, *gridPowerInverseTopic, err)
+				budgetPublishFailuresCounter.Inc()
 			}
 
-			for k, v := range data {
-				if dataCache[k] == v {
-					continue
+			if len(evseClients) > 1 {
+				// Also publish each EVSE's share on <topic>/<name>.
+				for i, budgetW := range fleet.Split(limit) {
+					topic := fmt.Sprintf("%s/%s", *gridPowerInverseTopic, evseNames[i])
+					if err := publishBudget(mqttClient, topic, byte(*excessQoS), *excessRetain, formatBudget(budgetW)); err != nil {
+						log.Printf("Error publishing EV budget %d to %s: %v", budgetW, topic, err)
+						budgetPublishFailuresCounter.Inc()
+					}
 				}
-
-				fmt.Fprintf(w, "event: %s\n", k)
-				fmt.Fprintf(w, "data: %s\n", v)
-				fmt.Fprint(w, "\n\n")
-				dataCache[k] = v
 			}
+			return nil
+		},
+	)
+
+	if len(evseClients) > 0 {
+		cont.SetEVSECount(len(evseClients))
+	}
+	cont.SetBudgetReporter(func(limit int32, reason powerwall.BudgetReason) {
+		snapshots.update(func(s *stateSnapshot) {
+			s.BudgetW = limit
+			s.Reason = string(reason)
+		})
+		reporter.ReportBudget(limit)
+		reporter.ReportBudgetReason(reason)
+	})
+	cont.SetLocation(loc)
+	cont.SetSolarFloor(*solarFloorW, *baselineLoadW)
+	cont.SetPhaseMaxAmps(*phaseMaxAmps)
+	cont.SetBatteryProtect(*batteryProtectDischargeW, *batteryProtectDuration)
+	cont.SetStaleAfter(*meterStaleAfter)
+	cont.SetGridServicesCooldown(*gridServicesCooldown)
+	cont.SetPriceThreshold(*priceThreshold, *priceMaxAge)
+	cont.SetStrategyRamp(*strategyRampDown, *strategyRampUp)
+	cont.SetSoftStart(*softStartRateW, *softStartDuration)
+	cont.SetStartupGrace(*startupGrace)
+	cont.SetSolarGate(*solarStartDelay, *solarStopDelay, *solarCooldown)
+	if *evSOCTopic != "" {
+		cont.SetEVTargetSOC(*evTargetSOC)
+	}
+	cont.SetBatteryTarget(*batteryTargetPercent, *batteryTargetHysteresis)
+	cont.SetStaleBudget(int32(*staleBudgetW))
+	cont.SetTempInterpolate(*tempInterpolate)
+	cont.SetZeroBudgetWhenDisconnected(*zeroWhenDisconnected)
+	cont.SetReserveMargin(*reserveMargin, *reserveMarginAll)
+	if *exportWindow != "" {
+		start, end, err := powerwall.ParseTimeWindow(*exportWindow)
+		if err != nil {
+			log.Fatalf("Invalid -export-window: %v", err)
+		}
+		cont.SetExportWindow(start, end)
+	}
 
-			w.(http.Flusher).Flush()
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	server := httpServer{certFile: *tlsCert, keyFile: *tlsKey, clientCAFile: *tlsClientCA}
 
-			select {
-			case <-r.Context().Done():
-				return
-			case <-ticker.C:
+	if *metricsListen != "" {
+		// Serve metrics on their own listener, so that scraping can stay on an
+		// internal interface while the dashboard is exposed elsewhere.
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(server.listenAndServe(*metricsListen, metricsMux))
+		}()
+	} else {
+		http.Handle("/metrics", promhttp.Handler())
+	}
+
+	if *solarForecastURL != "" {
+		forecastClient := &solarForecastClient{
+			client: &http.Client{Timeout: 30 * time.Second},
+			url:    *solarForecastURL,
+		}
+		go func() {
+			for {
+				if wh, err := forecastClient.GetRemainingTodayWh(time.Now()); err != nil {
+					log.Printf("Error fetching solar forecast: %v", err)
+				} else {
+					cont.SetSolarForecastRemainingWh(wh)
+					solarForecastGauge.Set(wh)
+				}
+				time.Sleep(*solarForecastInterval)
 			}
+		}()
+	}
+
+	// Buffered so that a request arriving mid-poll queues exactly one more poll.
+	pollNow := make(chan struct{}, 1)
+	triggerPoll := func() {
+		select {
+		case pollNow <- struct{}{}:
+		default:
 		}
-	}))
+	}
+
+	// logSnapshot logs every controller value, the budget and the last gateway
+	// responses as one block, whatever -debug is set to.
+	logSnapshot := func() {
+		snap := snapshots.Load()
+		b, err := json.MarshalIndent(struct {
+			State        powerwall.ControllerState
+			BudgetW      int32
+			Reason       powerwall.BudgetReason
+			Strategy     string
+			BatteryState powerwall.BatteryState
+			Gateway      map[string]json.RawMessage
+		}{
+			State:        cont.State(),
+			BudgetW:      snap.BudgetW,
+			Reason:       cont.GetBudgetReason(),
+			Strategy:     snap.Strategy,
+			BatteryState: snap.BatteryState,
+			Gateway:      teslaClient.LastPayloads(),
+		}, "", "  ")
+		if err != nil {
+			log.Printf("Error encoding snapshot: %v", err)
+			return
+		}
+		log.Printf("Snapshot:\n%s", b)
+	}
+
+	if !*noWeb {
+		registerWebHandlers(http.DefaultServeMux, snapshots, triggerPoll, logSnapshot)
+		registerConfigHandlers(http.DefaultServeMux, cont, *webPassword)
+		registerHAPackageHandler(http.DefaultServeMux, reporter)
+		registerMQTTResetHandler(http.DefaultServeMux, reporter, *webPassword)
+	}
+
 	go func() {
-		http.ListenAndServe(*listen, nil)
+		log.Fatal(server.listenAndServe(*listen, http.DefaultServeMux))
 	}()
 
+	if err := reporter.Subscribe(reporter.CommandTopic("POLL"), func(_ mqtt.Client, _ mqtt.Message) {
+		triggerPoll()
+	}); err != nil {
+		log.Fatalf("Error subscribing to poll command: %v", err)
+	}
+
+	if err := reporter.Subscribe(reporter.CommandTopic("SNAPSHOT"), func(_ mqtt.Client, _ mqtt.Message) {
+		logSnapshot()
+	}); err != nil {
+		log.Fatalf("Error subscribing to snapshot command: %v", err)
+	}
+
+	// Login replaces the HTTP client, so it's done from the poll loop rather
+	// than concurrently with a poll.
+	var reloginRequested atomic.Bool
+	if err := reporter.Subscribe(reporter.CommandTopic("RELOGIN"), func(_ mqtt.Client, _ mqtt.Message) {
+		log.Printf("Re-login to gateway requested")
+		reloginRequested.Store(true)
+		triggerPoll()
+	}); err != nil {
+		log.Fatalf("Error subscribing to relogin command: %v", err)
+	}
+
+	if err := reporter.Subscribe(reporter.CommandTopic("BUDGET"), func(_ mqtt.Client, msg mqtt.Message) {
+		budgetW, until, clear, err := parseBudgetOverride(string(msg.Payload()), time.Now())
+		switch {
+		case err != nil:
+			log.Printf("Ignoring budget override %q: %v", msg.Payload(), err)
+			return
+		case clear:
+			log.Printf("Clearing budget override")
+			cont.ClearBudgetOverride()
+		default:
+			log.Printf("Setting budget override to %d W (until %v)", budgetW, until)
+			cont.SetBudgetOverride(budgetW, until)
+		}
+		reporter.ReportBudgetOverride(cont.GetBudgetOverride())
+	}); err != nil {
+		log.Fatalf("Error subscribing to budget command: %v", err)
+	}
+
+	if err := reporter.Subscribe(reporter.CommandTopic("BOOST"), func(_ mqtt.Client, msg mqtt.Message) {
+		d, err := parseBoost(string(msg.Payload()))
+		if err != nil {
+			log.Printf("Ignoring boost: %v", err)
+			return
+		}
+		log.Printf("Boosting EV charging for %s", d)
+		cont.SetBoost(d)
+		reporter.ReportBoostRemaining(cont.GetBoostRemaining(time.Now()))
+	}); err != nil {
+		log.Fatalf("Error subscribing to boost command: %v", err)
+	}
+
+	if err := reporter.Subscribe(reporter.CommandTopic("ENABLE"), func(_ mqtt.Client, msg mqtt.Message) {
+		enabled, err := parseSwitch(string(msg.Payload()))
+		if err != nil {
+			log.Printf("Ignoring enable command: %v", err)
+			return
+		}
+		if enabled {
+			log.Printf("EV budget control enabled")
+		} else {
+			log.Printf("EV budget control disabled, holding the budget at 0")
+		}
+		cont.SetEnabled(enabled)
+		reporter.ReportEnabled(enabled)
+	}); err != nil {
+		log.Fatalf("Error subscribing to enable command: %v", err)
+	}
+
+	if *priceTopic != "" {
+		if err := reporter.Subscribe(*priceTopic, func(_ mqtt.Client, msg mqtt.Message) {
+			price, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+			if err != nil {
+				log.Printf("Ignoring price %q: %v", msg.Payload(), err)
+				return
+			}
+			cont.SetPrice(price)
+		}); err != nil {
+			log.Fatalf("Error subscribing to %s: %v", *priceTopic, err)
+		}
+	}
+
+	if *evSOCTopic != "" {
+		if err := reporter.Subscribe(*evSOCTopic, func(_ mqtt.Client, msg mqtt.Message) {
+			soc, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+			if err != nil {
+				log.Printf("Ignoring EV SOC %q: %v", msg.Payload(), err)
+				return
+			}
+			cont.SetEVSOC(soc)
+		}); err != nil {
+			log.Fatalf("Error subscribing to %s: %v", *evSOCTopic, err)
+		}
+	}
+
 	if *evChargeStrategyTopic != "" {
-		mqttClient.Subscribe(*evChargeStrategyTopic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		err := reporter.Subscribe(*evChargeStrategyTopic, func(_ mqtt.Client, msg mqtt.Message) {
 			log.Printf("Got message: %s", msg.Payload())
 
-			var strategy strategy
+			var strategy powerwall.Strategy
 			switch string(msg.Payload()) {
 			case "solar":
-				strategy = strategySolar
+				strategy = powerwall.StrategySolar
 			case "fullspeed":
-				strategy = strategyFullSpeed
+				strategy = powerwall.StrategyFullSpeed
 			case "offpeak":
-				strategy = strategyOffpeak
+				strategy = powerwall.StrategyOffpeak
+			case "batterytarget":
+				strategy = powerwall.StrategyBatteryTarget
+			case "price":
+				strategy = powerwall.StrategyPrice
 			default:
 				log.Fatalf("Charge strategy %s unknown", msg.Payload())
 			}
-			controllerStrategy.Store(string(msg.Payload()))
+			snapshots.update(func(s *stateSnapshot) { s.Strategy = string(msg.Payload()) })
 			cont.SetControllerStrategy(strategy)
-		}).Wait()
+		})
+		if err != nil {
+			log.Fatalf("Error subscribing to %s: %v", *evChargeStrategyTopic, err)
+		}
 	}
 
 	go func() {
@@ -300,71 +1003,352 @@ func main() {
 		}
 	}()
 
-	for {
+	// EVSEs are polled independently of the Powerwall, so temperature (which
+	// drives the derate) can be sampled more often than the meters. With
+	// multiple EVSEs, the controller and Home Assistant see their combined status.
+	interval := *evseInterval
+	if interval <= 0 {
+		interval = *pollingInterval
+	}
+	for i, evseClient := range evseClients {
+		i, evseClient := i, evseClient
+		offset := pollOffset()
+		go func() {
+			time.Sleep(offset)
+			evseTicker := time.NewTicker(interval)
+			lastDivertMode := powerwall.DivertUnknown
+			for ; ; <-evseTicker.C {
+				evseStatus, err := evseClient.GetStatus()
+				if err != nil {
+					// Can happen if OpenEVSE device is down for a while - log it and continue operating
+					log.Printf("Error getting status from EVSE %s: %v", evseNames[i], err)
+					continue
+				}
+
+				if evseStatus.DivertMode != lastDivertMode {
+					if evseStatus.DivertMode == powerwall.DivertNormal {
+						log.Printf("Warning: EVSE %s is in normal charge mode and ignores the EV budget. Switch it to eco mode to let powerwall2mqtt control charging", evseNames[i])
+					} else if lastDivertMode == powerwall.DivertNormal {
+						log.Printf("EVSE %s switched to %s charge mode", evseNames[i], evseStatus.DivertMode)
+					}
+					lastDivertMode = evseStatus.DivertMode
+				}
+
+				combined := fleet.Update(i, evseStatus)
+				cont.SetEVSETemp(combined.Temp)
+				// What the controller applies, which differs from the table
+				// while the temperature reading isn't plausible.
+				tempMaxAmps := cont.TempMaxAmps()
+				tempMaxAmpsGauge.Set(float64(tempMaxAmps))
+
+				cont.SetEVSECurrent(combined.MilliAmp)
+				cont.SetEVSEVoltage(combined.Volts)
+				if combined.AllSeen {
+					cont.SetEVSEMinAmps(combined.MinAmps)
+					cont.SetEVSEMaxAmps(combined.MaxAmps)
+					evseMaxCurrentGauge.Set(float64(combined.MaxAmps))
+					reporter.ReportEVSEMaxCurrent(combined.MaxAmps)
+				}
+				cont.SetEVConnected(powerwall.ConnectedType(combined.Connected))
+				reporter.ReportEVSETemperature(combined.Temp)
+				reporter.ReportEVSETempMaxAmps(tempMaxAmps)
+				if combined.DivertMode != powerwall.DivertUnknown {
+					reporter.ReportEVSEDivertMode(combined.DivertMode)
+				}
+				reporter.ReportEVSECurrent(combined.MilliAmp)
+				reporter.ReportEVSEPilotMismatch(combined.PilotMismatchMilliAmp, combined.HavePilot)
+				if targetMilliAmp, ok := cont.TargetMilliAmp(); ok {
+					gap := targetMilliAmp - combined.MilliAmp
+					evseCurrentGapGauge.Set(float64(gap) / 1000)
+					reporter.ReportEVSECurrentGap(gap)
+				}
+				reporter.ReportEVConnected(powerwall.ConnectedType(combined.Connected))
+				if i == 0 {
+					// Power factor is per EVSE - only the first one is reported.
+					reporter.ReportEVSEPowerFactor(evseStatus.PowerFactor(evsePhases))
+				}
+				if combined.AllSeen {
+					// Until then, the total is missing some EVSEs.
+					updateDaily("ev", combined.EnergyWh, reporter.ReportEVEnergyToday)
+				}
+			}
+		}()
+	}
+
+	gridServicesMode := powerwall.OperationUnknown
+	if *gridServicesModeFlag != "" {
+		gridServicesMode, err = powerwall.ParseOperationMode(*gridServicesModeFlag)
+		if err != nil {
+			log.Fatalf("Invalid -grid-services-mode: %v", err)
+		}
+	}
+	// Grid services and battery protection can overlap, so all their reserve
+	// changes go through one owner.
+	reserveOverrides := powerwall.NewReserveOverrides(teslaClient, *dryRun)
+	gridServices := powerwall.NewGridServicesAction(teslaClient, reserveOverrides, *gridServicesReserve, gridServicesMode, *dryRun)
+	batteryProtect := powerwall.NewBatteryProtectAction(teslaClient, reserveOverrides, *batteryProtectReserve)
+
+	// The backup reserve seen on the previous poll, to notice changes made
+	// outside this process. Changes matching the reserve reserveOverrides last
+	// set are our own.
+	var lastReservePercent float64
+	var haveReserve bool
+
+	// pollTesla reads everything from the gateway and feeds the controller. Any
+	// error aborts the cycle - values already set are kept.
+	pollTesla := func() error {
 		gridStatus, err := teslaClient.GetGridStatus()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		cont.SetLoadReduction(gridStatus.GridServicesActive)
+		if err := gridServices.Update(gridStatus.GridServicesActive); err != nil {
+			// Retried on the next poll.
+			log.Printf("Error changing Powerwall settings for grid services event: %v", err)
+		}
+		if err := batteryProtect.Update(cont.BatteryProtectActive()); err != nil {
+			// Retried on the next poll.
+			log.Printf("Error changing Powerwall reserve for battery protection: %v", err)
+		}
 
-		_, err = teslaClient.GetSystemStatus()
+		systemStatus, err := teslaClient.GetSystemStatus()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		cont.SetPowerwallFullPackWh(systemStatus.NominalFullPackEnergyWh)
 
-		metersResp, err := teslaClient.GetMeterAggregates()
+		metersResp, metersRaw, err := teslaClient.GetMeterAggregatesRaw()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		if v, ok := metersResp["site"]; ok {
-			cont.SetExportedSolarW(-v.InstantPower)
-		} else {
-			cont.SetExportedSolarW(0)
+		if *metersRawTopic != "" {
+			// Fire and forget - a slow broker must not hold up the poll.
+			mqttClient.Publish(*metersRawTopic, byte(*metersRawQoS), true, metersRaw)
 		}
 
-		if v, ok := metersResp["load"]; ok {
-			cont.SetLoadW(v.InstantPower)
-		} else {
-			cont.SetLoadW(0)
+		site, haveSite := metersResp["site"]
+		gridW := site.InstantPower
+		load, haveLoad := metersResp["load"]
+		loadW := load.InstantPower
+		if haveLoad {
+			// Per phase currents come from the Powerwall even with an external grid
+			// meter - it only reports the total.
+			phaseAmps := [3]float64{load.CurrentA, load.CurrentB, load.CurrentC}
+			for i, phase := range []string{"a", "b", "c"} {
+				loadPhaseCurrentGauge.WithLabelValues(phase).Set(phaseAmps[i])
+			}
+			cont.SetLoadPhaseCurrents(phaseAmps)
+		}
+
+		if gridMeter != nil {
+			if w, err := gridMeter.GetGridPowerW(); err != nil {
+				log.Printf("Error reading grid meter, using Powerwall site meter: %v", err)
+			} else {
+				// The Powerwall computes load as site + solar + battery. Recompute it
+				// from the external grid reading so the two stay consistent.
+				gridW, haveSite = w, true
+				loadW, haveLoad = w+metersResp["solar"].InstantPower+metersResp["battery"].InstantPower, true
+			}
+		}
+
+		// A meter missing from the response (e.g. while the gateway restarts)
+		// keeps its last value. The controller stops charging once it goes stale.
+		if haveSite {
+			cont.SetExportedSolarW(-gridW)
+			reporter.ReportGridW(gridW)
+		}
+
+		if haveLoad {
+			cont.SetLoadW(loadW)
+			reporter.ReportLoadW(loadW)
+
+			// The load meter includes the EV. Without an EVSE there's no way to
+			// tell house consumption apart, so the metric is left out.
+			if evW, ok := fleet.PowerW(); ok && len(evseClients) > 0 {
+				powerGauge.WithLabelValues("house").Set(loadW - evW)
+			}
 		}
 
 		if v, ok := metersResp["solar"]; ok {
 			cont.SetSolarW(v.InstantPower)
-		} else {
-			cont.SetSolarW(0)
+			reporter.ReportSolarW(v.InstantPower)
+			updateDaily("solar", v.EnergyExported, reporter.ReportSolarEnergyToday)
 		}
 
 		if v, ok := metersResp["battery"]; ok {
 			cont.SetExportedBatteryW(v.InstantPower)
-		} else {
-			cont.SetExportedBatteryW(0)
+			reporter.ReportBatteryExportW(v.InstantPower)
+
+			batteryState := powerwall.BatteryStateFor(v.InstantPower, *batteryIdleDeadband)
+			reporter.ReportBatteryState(batteryState)
+			for _, s := range powerwall.BatteryStates {
+				if s == batteryState {
+					batteryStateGauge.WithLabelValues(string(s)).Set(1)
+				} else {
+					batteryStateGauge.WithLabelValues(string(s)).Set(0)
+				}
+			}
+			snapshots.update(func(s *stateSnapshot) {
+				s.BatteryState = batteryState
+			})
 		}
 
 		soe, err := teslaClient.GetStateOfEnergy()
+		switch {
+		case errors.Is(err, powerwall.ErrImplausibleSOE):
+			// Nothing trustworthy to report yet, but the rest of the poll is fine.
+			log.Printf("Skipping the Powerwall battery level: %v", err)
+		case err != nil:
+			return err
+		default:
+			cont.SetPowerwallBatteryLevelPercent(soe.Percentage)
+			reporter.ReportPowerwallBatteryLevel(soe.Percentage)
+		}
+
+		op, err := teslaClient.GetOperation()
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		cont.SetOperationMode(op.Mode)
+		reporter.ReportOperationMode(op.Mode)
+		cont.SetBackupReservePercent(op.BackupReservePercent)
+		selfSet, haveSelfSet := reserveOverrides.TakeLastSet()
+		if haveReserve && op.BackupReservePercent != lastReservePercent {
+			if haveSelfSet && selfSet == op.BackupReservePercent {
+				log.Printf("Powerwall backup reserve changed from %.0f%% to %.0f%% by powerwall2mqtt", lastReservePercent, op.BackupReservePercent)
+			} else {
+				log.Printf("Powerwall backup reserve changed from %.0f%% to %.0f%%", lastReservePercent, op.BackupReservePercent)
+				reporter.ReportBackupReserveChange(lastReservePercent, op.BackupReservePercent)
+			}
 		}
-		cont.SetPowerwallBatteryLevelPercent(soe.Percentage)
+		lastReservePercent, haveReserve = op.BackupReservePercent, true
 
-		if op, err := teslaClient.GetOperation(); err != nil {
-			log.Fatal(err)
-		} else {
-			cont.SetOperationMode(op.Mode)
+		return nil
+	}
+
+	// The offset sets the phase of every later poll too, as they run off a
+	// ticker started afterwards.
+	time.Sleep(pollOffset())
+	ticker := time.NewTicker(*pollingInterval)
+
+	var dog *watchdog
+	if *watchdogTimeout > 0 {
+		if *watchdogTimeout <= *pollingInterval {
+			log.Fatal("-watchdog-timeout must be longer than -poll-interval")
 		}
+		dog = newWatchdog(*watchdogTimeout)
+		go dog.run()
+	}
 
-		if evseClient != nil {
-			evseStatus, err := evseClient.GetStatus()
-			if err != nil {
-				// Can happen if OpenEVSE device is down for a while - log it and continue operating
-				log.Printf("Error getting status from OpenEVSE: %v", err)
+	breaker := powerwall.NewCircuitBreaker(*breakerFailures, *breakerCooldown)
+	teslaReachableGauge.Set(1)
+
+	lastSuccessfulPoll := time.Now()
+	consecutiveFailures := 0
+	var forcedPoll bool
+	for {
+		cycleStart := time.Now()
+		if reloginRequested.Swap(false) {
+			if err := login(); err != nil {
+				log.Printf("Error logging in on request: %v", err)
 			} else {
-				cont.SetEVSETemp(Temperature(evseStatus.Temp) * DeciCelcius)
-				cont.SetEVSECurrent(evseStatus.MilliAmp)
-				cont.SetEVConnected(evseStatus.Vehicle == 1)
+				log.Printf("Logged in to gateway on request")
 			}
 		}
 
-		<-ticker.C
+		var pollErr error
+		if breaker.Allow(cycleStart) {
+			pollErr = pollTesla()
+			if pollErr != nil {
+				if !breaker.Open() {
+					log.Printf("Error polling Powerwall: %v", pollErr)
+				}
+				if powerwall.IsAuthError(pollErr) {
+					log.Printf("Session rejected by gateway, logging in again")
+					if err := login(); err != nil {
+						log.Printf("Error logging in: %v", err)
+					}
+				}
+			} else {
+				lastSuccessfulPoll = time.Now()
+			}
+			breaker.Record(pollErr, time.Now())
+
+			// A re-login alone doesn't count as recovery - only a successful poll does.
+			if pollErr != nil {
+				consecutiveFailures++
+			} else {
+				consecutiveFailures = 0
+			}
+			consecutiveFailuresGauge.Set(float64(consecutiveFailures))
+		} else {
+			pollErr = errPollingPaused
+		}
+		if breaker.Open() {
+			teslaReachableGauge.Set(0)
+		} else {
+			teslaReachableGauge.Set(1)
+		}
+
+		cont.Tick(time.Now())
+
+		// If the gateway has been unreachable for too long, stop driving the EV
+		// from old data until a poll succeeds again.
+		dataStale := *maxDataAge > 0 && time.Since(lastSuccessfulPoll) > *maxDataAge
+		cont.SetDataStale(dataStale)
+		reporter.ReportDataStale(dataStale)
+		if dataStale {
+			dataStaleGauge.Set(1)
+		} else {
+			dataStaleGauge.Set(0)
+		}
+
+		reporter.ReportMinutesUntilOffPeak(cont.MinutesUntilOffPeak(time.Now()))
+		offPeak := cont.IsOffPeak(time.Now())
+		reporter.ReportOffPeak(offPeak)
+		if offPeak {
+			offPeakGauge.Set(1)
+		} else {
+			offPeakGauge.Set(0)
+		}
+		gridServicesActive, gridServicesEvents := cont.GridServicesToday(time.Now())
+		gridServicesActiveGauge.Set(gridServicesActive.Seconds())
+		gridServicesEventsGauge.Set(float64(gridServicesEvents))
+		reporter.ReportGridServicesToday(gridServicesActive, gridServicesEvents)
+		reporter.ReportBudgetOverride(cont.GetBudgetOverride())
+		reporter.ReportBoostRemaining(cont.GetBoostRemaining(time.Now()))
+		reporter.ReportEnabled(cont.Enabled())
+		reason := cont.GetBudgetReason()
+		reporter.ReportBudgetReason(reason)
+
+		state := cont.State()
+		snapshots.update(func(s *stateSnapshot) {
+			s.ControllerState = state
+			s.Reason = string(reason)
+			s.UpdatedAt = time.Now()
+		})
+
+		selfStats.recordCycle(time.Since(cycleStart), pollErr == nil)
+		if dog != nil {
+			dog.pet()
+		}
+		if *availabilityHeartbeat > 0 {
+			reporter.Heartbeat()
+		}
+
+		if forcedPoll {
+			// Re-apply the budget even if nothing changed, so on-demand polls
+			// always produce a fresh decision.
+			cont.Recompute()
+		}
+
+		select {
+		case <-ticker.C:
+			forcedPoll = false
+		case <-pollNow:
+			log.Printf("Polling on demand")
+			forcedPoll = true
+		}
 	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Every metric main creates must be under -metrics-namespace. The metrics are
+// created inline in main, so check the source.
+func TestMetricOptsUseNamespace(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found int
+	ast.Inspect(f, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		sel, ok := lit.Type.(*ast.SelectorExpr)
+		if !ok || !strings.HasSuffix(sel.Sel.Name, "Opts") {
+			return true
+		}
+		if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "prometheus" {
+			return true
+		}
+		found++
+
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if key, ok := kv.Key.(*ast.Ident); !ok || key.Name != "Namespace" {
+				continue
+			}
+			if star, ok := kv.Value.(*ast.StarExpr); ok {
+				if ident, ok := star.X.(*ast.Ident); ok && ident.Name == "metricsNamespace" {
+					return true
+				}
+			}
+		}
+		t.Errorf("%s: prometheus.%s without Namespace: *metricsNamespace", fset.Position(lit.Pos()), sel.Sel.Name)
+		return true
+	})
+	if found == 0 {
+		t.Fatal("no metric options found in main.go")
+	}
+}
+
+func TestCollectorsUseNamespace(t *testing.T) {
+	for _, namespace := range []string{"energy", "home"} {
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "instantaneous_power",
+			Help:      "Instantaneous power (W)",
+		}, []string{"meter"})
+		gauge.WithLabelValues("solar").Set(1500)
+
+		kw := newKWCollector(namespace)
+		kw.add(gauge, "instantaneous_power_kw", "Instantaneous power (kW)", []string{"meter"})
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(gauge, kw, newSelfCollector(namespace))
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+
+		want := map[string]bool{
+			namespace + "_instantaneous_power":                  true,
+			namespace + "_instantaneous_power_kw":               true,
+			namespace + "_exporter_up":                          true,
+			namespace + "_exporter_goroutines":                  true,
+			namespace + "_exporter_last_cycle_duration_seconds": true,
+		}
+		for _, mf := range families {
+			if !want[mf.GetName()] {
+				t.Errorf("namespace %q: unexpected metric %s", namespace, mf.GetName())
+			}
+			delete(want, mf.GetName())
+		}
+		for name := range want {
+			t.Errorf("namespace %q: missing metric %s", namespace, name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package powerwall
+
+import "log"
+
+// BatteryProtectAction raises the Powerwall's backup reserve while battery
+// protection is active, so it stops carrying the house, and restores the
+// previous reserve afterwards. Only accessed from the poll loop.
+type BatteryProtectAction struct {
+	reserve        *ReserveOverrides
+	client         *TeslaClient
+	reservePercent float64 // Backup reserve while active. Negative leaves it alone
+
+	active bool
+}
+
+const batteryProtectOwner = "Battery protection"
+
+// NewBatteryProtectAction returns an action that applies reservePercent through
+// reserve while battery protection is active. A negative reservePercent does
+// nothing.
+func NewBatteryProtectAction(client *TeslaClient, reserve *ReserveOverrides, reservePercent float64) *BatteryProtectAction {
+	return &BatteryProtectAction{
+		reserve:        reserve,
+		client:         client,
+		reservePercent: reservePercent,
+	}
+}
+
+// Update raises or restores the reserve when active changes.
+func (a *BatteryProtectAction) Update(active bool) error {
+	if a.reservePercent < 0 || active == a.active {
+		return nil
+	}
+
+	if !active {
+		if err := a.reserve.Pop(batteryProtectOwner); err != nil {
+			return err
+		}
+		a.active = false
+		return nil
+	}
+
+	current, ok := a.reserve.Current()
+	if !ok {
+		op, err := a.client.GetOperation()
+		if err != nil {
+			return err
+		}
+		current = op.BackupReservePercent
+	}
+	if current < a.reservePercent {
+		log.Printf("Battery protection started, raising Powerwall reserve from %.0f%% to %.0f%%", current, a.reservePercent)
+		if err := a.reserve.Push(batteryProtectOwner, a.reservePercent); err != nil {
+			return err
+		}
+	}
+	a.active = true
+	return nil
+}
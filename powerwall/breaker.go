@@ -0,0 +1,69 @@
+package powerwall
+
+import (
+	"log"
+	"time"
+)
+
+// CircuitBreaker stops polling the gateway after too many consecutive failed
+// poll cycles. Once open, a single probe cycle is allowed every cooldown, and
+// the first one to succeed closes it again. A nil *CircuitBreaker never opens.
+// Only accessed from the poll loop.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	open      bool
+	nextProbe time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a poll cycle should run at now.
+func (b *CircuitBreaker) Allow(now time.Time) bool {
+	if b == nil || !b.open {
+		return true
+	}
+	return !now.Before(b.nextProbe)
+}
+
+// Open reports whether polling is currently suspended.
+func (b *CircuitBreaker) Open() bool {
+	return b != nil && b.open
+}
+
+// Record updates the breaker with the outcome of a poll cycle.
+func (b *CircuitBreaker) Record(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	if err == nil {
+		if b.open {
+			log.Printf("Gateway reachable again, resuming polling")
+		}
+		b.failures = 0
+		b.open = false
+		return
+	}
+
+	b.failures++
+	if !b.open && b.failures >= b.threshold {
+		log.Printf("%d consecutive poll failures (last: %v), pausing polling for %s", b.failures, err, b.cooldown)
+		b.open = true
+	}
+	if b.open {
+		// A failed probe waits out another cooldown without logging again.
+		b.nextProbe = now.Add(b.cooldown)
+	}
+}
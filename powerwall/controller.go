@@ -0,0 +1,1783 @@
+// Package powerwall decides how much power an EV may draw based on Powerwall
+// readings, and holds the clients for the Powerwall gateway, EVSEs and MQTT.
+package powerwall
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Strategy int
+
+const (
+	StrategyUnknown Strategy = iota
+	StrategySolar
+	StrategyFullSpeed
+	StrategyOffpeak
+	StrategyBatteryTarget
+	StrategyPrice
+)
+
+type observedValues int
+
+const (
+	observedEVBattery observedValues = 1 << iota
+	observedExportedSolar
+	observedBattery
+	observedLR
+	observedStrategy
+	observedTemp
+	observedLoad
+	observedSolar
+	observedOperationMode
+	observedBatteryLevel
+	observedEVCurrent
+	observedEVConnected
+	observedEVVoltage
+	observedSolarForecast
+	observedPowerwallCapacity
+	observedPrice
+	observedEVSOC
+	observedBackupReserve
+	observedLoadPhases
+)
+
+// meterValues are sensors sourced from the Powerwall meters. They are subject
+// to the staleness timeout.
+var meterValues = []observedValues{observedExportedSolar, observedSolar, observedLoad, observedBattery, observedLoadPhases}
+
+// startupValues must all have been seen for control to start before the
+// startup grace period is over.
+var startupValues = []observedValues{
+	observedStrategy, observedExportedSolar, observedSolar, observedLoad, observedBattery,
+	observedBatteryLevel, observedOperationMode, observedLR,
+}
+
+type Temperature int64
+
+func (t Temperature) String() string {
+	return fmt.Sprintf("%d.%d C", t/10, t%10)
+}
+
+const (
+	DeciCelcius Temperature = 1
+	Celsius                 = 10 * DeciCelcius
+)
+
+const (
+	maxAmps       = 40
+	minAmps       = 8
+	volts         = 240 // Used unless the EVSE reports a plausible voltage
+	minValidVolts = 90
+	maxValidVolts = 270
+	minSitePowerW = -100000 // 100kW. Don't expect single home to pull more than this from the grid.
+
+	rampStep = time.Second // How often the budget is updated during a ramp
+)
+
+type tempClamp struct {
+	temp    Temperature
+	maxAmps int32
+}
+
+// tempClamps are the EVSE current limits above each temperature, hottest first.
+var tempClamps = []tempClamp{
+	{50 * Celsius, 8},
+	{49 * Celsius, 12},
+	{48 * Celsius, 16},
+	{47 * Celsius, 24},
+	{46 * Celsius, 32},
+}
+
+type ConnectedType bool
+
+func (c ConnectedType) String() string {
+	if c {
+		return "Connected"
+	} else {
+		return "Not Connected"
+	}
+}
+
+// BatteryState is whether the Powerwall is charging, discharging or idle.
+type BatteryState string
+
+const (
+	BatteryCharging    BatteryState = "charging"
+	BatteryDischarging BatteryState = "discharging"
+	BatteryIdle        BatteryState = "idle"
+)
+
+// BatteryStates lists every BatteryState, for enum style metrics.
+var BatteryStates = []BatteryState{BatteryCharging, BatteryDischarging, BatteryIdle}
+
+// BatteryStateFor classifies the Powerwall's exported power. Anything within
+// deadbandW of zero counts as idle, since the meter is rarely exactly 0.
+func BatteryStateFor(exportedBatteryW, deadbandW float64) BatteryState {
+	switch {
+	case exportedBatteryW > deadbandW:
+		return BatteryDischarging
+	case exportedBatteryW < -deadbandW:
+		return BatteryCharging
+	default:
+		return BatteryIdle
+	}
+}
+
+type Controller struct {
+	lock       sync.Mutex
+	cond       *sync.Cond
+	now        func() time.Time // time.Now, except in tests
+	seenValues observedValues
+	updatedAt  map[observedValues]time.Time
+
+	// Meter values older than this are treated as unknown (0 disables)
+	staleAfter  time.Duration
+	metersStale bool
+
+	// Set when no Powerwall poll has succeeded for a while. All control is
+	// suspended and staleBudgetW is applied instead.
+	dataStale    bool
+	staleBudgetW int32
+
+	// Sensors
+	pwBatteryLevelPercent float64 // 0.0 - 100.0
+	backupReservePercent  float64 // As configured on the Powerwall
+	exportedBatteryW      float64
+	exportedSolarW        float64
+	solarW                float64
+	loadW                 float64
+	operationMode         OperationMode
+	temp                  Temperature
+	evseMilliAmp          int64
+	evseVolts             int64
+	evConnected           ConnectedType
+	loadReductionEnabled  bool
+	controllerStrategy    Strategy
+	setEcoPowerLimit      func(int32) error
+	reportBudget          func(int32, BudgetReason) // Called for every budget, even ones not applied. May be nil
+	evseCount             int32                     // EVSEs sharing the budget
+	tempImplausible       bool                      // Last EVSE temperature reading was ignored
+	tempInterpolate       bool                      // Derate linearly between tempClamps
+	zeroWhenDisconnected  bool                      // Budget is 0 while the EVSE reports no EV
+	evseMinAmps           int32                     // Min current the EVSEs charge at. 0 if unknown
+	evseMaxAmps           int32                     // Max current advertised by the EVSEs (summed). 0 if unknown
+	loadPhaseAmps         [3]float64
+
+	// Three phase supply: the budget is capped so the most loaded phase stays
+	// under phaseMaxAmps, even if the total has room. 0 disables the cap.
+	phaseMaxAmps float64
+
+	// Off peak duration
+	peakRatesStartMinute int64 // 16:00 is 16*60 + 0 = 960
+	peakRatesEndMinute   int64 // 21:00 is 21*60 + 0 = 1260
+	offPeak              bool  // As of the last Tick
+
+	// Export window (like premium export credits): no EV charging at all,
+	// whatever the strategy. Independent of the peak rates window, and may
+	// wrap around midnight. Disabled unless exportWindowSet.
+	exportStartMinute int64
+	exportEndMinute   int64
+	exportWindowSet   bool
+	inExportWindow    bool // As of the last Tick
+
+	// Gross solar gating. When solarFloorW is non-zero and solar production is
+	// above it, the EV budget is sized from solarW - baselineLoadW instead of
+	// net export.
+	solarFloorW   float64
+	baselineLoadW float64
+
+	// strategyBatteryTarget: solar goes to the Powerwall until it reaches
+	// batteryTargetPercent, then excess goes to the EV until the Powerwall
+	// drops batteryTargetHysteresis below the target.
+	batteryTargetPercent    float64
+	batteryTargetHysteresis float64
+	batteryTargetReached    bool
+
+	// Stop EV charging while the Powerwall is within reserveMarginPercent of
+	// its backup reserve (negative disables). Time based strategies and full
+	// speed are only clamped if reserveMarginAllStrategies is set.
+	reserveMarginPercent       float64
+	reserveMarginAllStrategies bool
+
+	solarForecastRemainingWh float64 // Forecast production for the rest of today
+	pwFullPackWh             float64
+
+	reason BudgetReason // Why the last budget was chosen
+
+	// Full speed charging, regardless of strategy, until boostUntil.
+	boostUntil time.Time
+
+	// Manual budget override, applied regardless of strategy while active.
+	// A zero budgetOverrideUntil means no expiry.
+	budgetOverrideActive bool
+	budgetOverrideW      int32
+	budgetOverrideUntil  time.Time
+
+	// strategyPrice: charge at full speed while the price is below
+	// priceThreshold. Falls back to the off-peak window if the price is older
+	// than priceMaxAge.
+	price          float64
+	priceThreshold float64
+	priceMaxAge    time.Duration
+	priceStale     bool
+
+	gridServicesCooldown       time.Duration
+	gridServicesCooldownActive bool
+	loadReductionEndedAt       time.Time
+
+	// Grid services stats since midnight in loc. gridServicesStartedAt is
+	// zero while no event is active.
+	loc                     *time.Location
+	gridServicesDay         string
+	gridServicesStartedAt   time.Time
+	gridServicesActiveToday time.Duration // Completed events only
+	gridServicesEventsToday int
+
+	// Ramp from rampFromW to the new budget after a strategy change, over
+	// rampDown (budget dropping) or rampUp (budget rising). A zero duration
+	// switches immediately. rampStart is zero when no ramp is in progress.
+	rampDown       time.Duration
+	rampUp         time.Duration
+	rampFromW      int32
+	rampStart      time.Time
+	lastBudgetW    int32 // Last budget passed to setEcoPowerLimit
+	haveLastBudget bool
+
+	rampWakeupPending bool
+
+	// Solar start/stop gate, against charging stopping and starting over and
+	// over when solar hovers around the minimum charge rate. Charging starts
+	// once the solar budget has been above the minimum for solarStartDelay,
+	// and at least solarCooldown after it last stopped. It stops once the
+	// budget has been below the minimum for solarStopDelay, and is held at
+	// the minimum until then. Disabled if both delays are 0.
+	solarStartDelay time.Duration
+	solarStopDelay  time.Duration
+	solarCooldown   time.Duration
+	solarGateOn     bool
+	solarAboveSince time.Time // Zero while below the minimum
+	solarBelowSince time.Time // Zero while above the minimum
+	solarStoppedAt  time.Time
+
+	// Battery protection: once the Powerwall has discharged more than
+	// protectDischargeW for protectDuration, the budget is 0 until it has
+	// been below that for protectDuration again. 0 disables.
+	protectDischargeW   float64
+	protectDuration     time.Duration
+	protectActive       bool
+	protectChangingFrom time.Time // When discharge crossed the threshold. Zero if it hasn't since the last change
+
+	// No budget is applied until graceUntil, unless all startupValues have
+	// been seen before then. Zero once the grace period is over.
+	graceUntil time.Time
+
+	// Soft start: for softStartDuration after the budget goes from 0 to
+	// non-zero, it rises by at most softStartRateW per second. 0 disables.
+	// softStartAt is zero when no soft start is in progress.
+	softStartRateW    float64
+	softStartDuration time.Duration
+	softStartAt       time.Time
+
+	// Operator master switch. While disabled, the budget is parked at 0 once
+	// (disabledParked) and then left alone, while monitoring carries on.
+	disabled       bool
+	disabledParked bool
+
+	// Stop charging once the EV reaches evTargetSOC. 0 disables the target
+	// (e.g. no SOC source is configured).
+	evSOC       float64
+	evTargetSOC float64
+}
+
+func NewController(
+	setEcoPowerLimit func(int32) error,
+) *Controller {
+	cont := &Controller{
+		updatedAt:            make(map[observedValues]time.Time),
+		now:                  time.Now,
+		setEcoPowerLimit:     setEcoPowerLimit,
+		peakRatesStartMinute: 16*60 + 0, // default 16:00 (PGE E-TOU-C)
+		peakRatesEndMinute:   21*60 + 0, // default 21:00
+		evseCount:            1,
+		loc:                  time.Local,
+		reserveMarginPercent: -1,
+	}
+
+	cont.cond = sync.NewCond(&cont.lock)
+	return cont
+}
+
+func updateSensor[T comparable](c *Controller, oldValue *T, newValue T, obs observedValues) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var shouldNotify bool
+	if *oldValue != newValue {
+		*oldValue = newValue
+		shouldNotify = true
+	}
+	c.seenValues |= obs
+	c.updatedAt[obs] = c.now()
+	if shouldNotify {
+		c.cond.Signal()
+	}
+}
+
+func (c *Controller) SetPowerwallBatteryLevelPercent(batt float64) {
+	updateSensor(c, &c.pwBatteryLevelPercent, batt, observedBatteryLevel)
+}
+
+func (c *Controller) SetBackupReservePercent(percent float64) {
+	updateSensor(c, &c.backupReservePercent, percent, observedBackupReserve)
+}
+
+func (c *Controller) SetExportedBatteryW(batteryW float64) {
+	updateSensor(c, &c.exportedBatteryW, batteryW, observedBattery)
+}
+
+func (c *Controller) SetExportedSolarW(solarW float64) {
+	updateSensor(c, &c.exportedSolarW, solarW, observedExportedSolar)
+}
+
+// SetLoadPhaseCurrents sets the current (A) on each phase of the load meter,
+// EV included.
+func (c *Controller) SetLoadPhaseCurrents(amps [3]float64) {
+	updateSensor(c, &c.loadPhaseAmps, amps, observedLoadPhases)
+}
+
+func (c *Controller) SetSolarW(solarW float64) {
+	updateSensor(c, &c.solarW, solarW, observedSolar)
+}
+
+func (c *Controller) SetLoadW(loadW float64) {
+	updateSensor(c, &c.loadW, loadW, observedLoad)
+}
+
+func (c *Controller) SetOperationMode(operationMode OperationMode) {
+	updateSensor(c, &c.operationMode, operationMode, observedOperationMode)
+}
+
+func (c *Controller) SetLoadReduction(enabled bool) {
+	c.lock.Lock()
+	now := c.now()
+	c.rollGridServicesDay(now)
+	switch {
+	case enabled && c.gridServicesStartedAt.IsZero():
+		c.gridServicesStartedAt = now
+		c.gridServicesEventsToday++
+	case !enabled && !c.gridServicesStartedAt.IsZero():
+		c.gridServicesActiveToday += now.Sub(c.gridServicesStartedAt)
+		c.gridServicesStartedAt = time.Time{}
+	}
+
+	if c.loadReductionEnabled && !enabled && c.gridServicesCooldown > 0 {
+		// The grid is often still stressed right after an event ends.
+		c.loadReductionEndedAt = c.now()
+		c.gridServicesCooldownActive = true
+		log.Printf("Grid services event ended, keeping EV charging off for %s", c.gridServicesCooldown)
+	}
+	c.lock.Unlock()
+
+	updateSensor(c, &c.loadReductionEnabled, enabled, observedLR)
+}
+
+// rollGridServicesDay resets the daily grid services stats at local midnight.
+// Called with lock held.
+func (c *Controller) rollGridServicesDay(now time.Time) {
+	day := now.In(c.loc).Format("2006-01-02")
+	if day == c.gridServicesDay {
+		return
+	}
+
+	c.gridServicesDay = day
+	c.gridServicesActiveToday = 0
+	c.gridServicesEventsToday = 0
+	if !c.gridServicesStartedAt.IsZero() {
+		// An event running over midnight counts towards both days.
+		y, m, d := now.In(c.loc).Date()
+		c.gridServicesStartedAt = time.Date(y, m, d, 0, 0, 0, 0, c.loc)
+		c.gridServicesEventsToday = 1
+	}
+}
+
+// GridServicesToday returns how long grid services (VPP) events have been
+// active since local midnight, and how many there were.
+func (c *Controller) GridServicesToday(now time.Time) (time.Duration, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rollGridServicesDay(now)
+
+	active := c.gridServicesActiveToday
+	if !c.gridServicesStartedAt.IsZero() {
+		active += now.Sub(c.gridServicesStartedAt)
+	}
+	return active, c.gridServicesEventsToday
+}
+
+// SetBudgetReporter sets a func that is called with every budget computed,
+// including ones held back from the EVSE during the startup grace period.
+func (c *Controller) SetBudgetReporter(report func(budgetW int32, reason BudgetReason)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reportBudget = report
+}
+
+// SetLocation sets the time zone of the peak and export windows, and whose
+// midnight resets daily stats.
+func (c *Controller) SetLocation(loc *time.Location) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.loc = loc
+}
+
+// SetGridServicesCooldown sets how long EV charging stays off after a grid
+// services (VPP) event ends.
+func (c *Controller) SetGridServicesCooldown(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gridServicesCooldown = d
+}
+
+func (c *Controller) SetControllerStrategy(s Strategy) {
+	c.lock.Lock()
+	if c.seen(observedStrategy) && s != c.controllerStrategy && c.haveLastBudget {
+		// Ease into the new strategy's budget from wherever the old one left off.
+		c.rampFromW = c.lastBudgetW
+		c.rampStart = c.now()
+	}
+	c.lock.Unlock()
+
+	updateSensor(c, &c.controllerStrategy, s, observedStrategy)
+}
+
+// minPlausibleTemp is the coldest EVSE temperature that is believed.
+const minPlausibleTemp = -20 * Celsius
+
+// SetEVSETemp records the EVSE temperature. An implausible reading (including
+// exactly 0, which is what a missing field decodes to) is ignored, keeping the
+// last good one. Until there is a good reading, charging is capped at the minimum
+// charge current.
+func (c *Controller) SetEVSETemp(temp Temperature) {
+	if temp == 0 || temp <= minPlausibleTemp {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if !c.tempImplausible {
+			log.Printf("Ignoring implausible EVSE temperature %s", temp)
+			c.tempImplausible = true
+			c.cond.Signal()
+		}
+		return
+	}
+
+	c.lock.Lock()
+	if c.tempImplausible {
+		log.Printf("EVSE temperature is plausible again: %s", temp)
+		c.tempImplausible = false
+	}
+	c.lock.Unlock()
+
+	updateSensor(c, &c.temp, temp, observedTemp)
+}
+
+func (c *Controller) SetEVSECurrent(milliAmp int64) {
+	updateSensor(c, &c.evseMilliAmp, milliAmp, observedEVCurrent)
+}
+
+func (c *Controller) SetEVSEVoltage(volts int64) {
+	updateSensor(c, &c.evseVolts, volts, observedEVVoltage)
+}
+
+func (c *Controller) SetSolarForecastRemainingWh(wh float64) {
+	updateSensor(c, &c.solarForecastRemainingWh, wh, observedSolarForecast)
+}
+
+func (c *Controller) SetPowerwallFullPackWh(wh float64) {
+	updateSensor(c, &c.pwFullPackWh, wh, observedPowerwallCapacity)
+}
+
+func (c *Controller) SetEVConnected(connected ConnectedType) {
+	updateSensor(c, &c.evConnected, connected, observedEVConnected)
+}
+
+// SetZeroBudgetWhenDisconnected makes the budget drop to 0 as soon as the EVSE
+// reports the EV unplugged, and resume normal control once it is plugged in.
+func (c *Controller) SetZeroBudgetWhenDisconnected(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.zeroWhenDisconnected = enabled
+	c.cond.Signal()
+}
+
+// SetSolarFloor enables sizing the EV budget from gross solar production
+// (minus an assumed baseline house load) whenever production exceeds floorW.
+// A floorW of 0 disables this and only net export is used.
+func (c *Controller) SetSolarFloor(floorW, baselineLoadW float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.solarFloorW = floorW
+	c.baselineLoadW = baselineLoadW
+}
+
+// SetPrice records the current electricity price.
+func (c *Controller) SetPrice(price float64) {
+	updateSensor(c, &c.price, price, observedPrice)
+}
+
+// SetPriceThreshold configures strategyPrice.
+func (c *Controller) SetPriceThreshold(threshold float64, maxAge time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.priceThreshold = threshold
+	c.priceMaxAge = maxAge
+}
+
+func (c *Controller) SetEVSOC(percent float64) {
+	updateSensor(c, &c.evSOC, percent, observedEVSOC)
+}
+
+// SetEVTargetSOC stops charging once the EV state of charge reaches percent.
+func (c *Controller) SetEVTargetSOC(percent float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evTargetSOC = percent
+}
+
+// SetBatteryTarget configures strategyBatteryTarget.
+func (c *Controller) SetBatteryTarget(percent, hysteresis float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.batteryTargetPercent = percent
+	c.batteryTargetHysteresis = hysteresis
+}
+
+// SetReserveMargin stops EV charging while the Powerwall is within percent of
+// its backup reserve. A negative percent disables the clamp. Unless
+// allStrategies is set, the full speed, offpeak and price strategies (and
+// their off-peak charging) are left alone.
+func (c *Controller) SetReserveMargin(percent float64, allStrategies bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reserveMarginPercent = percent
+	c.reserveMarginAllStrategies = allStrategies
+}
+
+// SetStaleAfter sets how long meter readings stay valid without an update.
+func (c *Controller) SetStaleAfter(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.staleAfter = d
+}
+
+// SetDataStale suspends normal control while Powerwall data can't be trusted.
+func (c *Controller) SetDataStale(stale bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dataStale != stale {
+		c.dataStale = stale
+		if stale {
+			log.Printf("Powerwall data is stale, holding EV budget at %d W", c.staleBudgetW)
+		} else {
+			log.Printf("Powerwall data is fresh again, resuming EV control")
+		}
+		c.cond.Signal()
+	}
+}
+
+// SetTempInterpolate makes the temperature derate change gradually between
+// the clamp temperatures instead of in steps.
+func (c *Controller) SetTempInterpolate(interpolate bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tempInterpolate = interpolate
+	c.cond.Signal()
+}
+
+// SetStaleBudget sets the EV budget applied while data is stale.
+func (c *Controller) SetStaleBudget(budgetW int32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.staleBudgetW = budgetW
+}
+
+func (c *Controller) stale(obs observedValues, now time.Time) bool {
+	return c.seen(obs) && c.staleAfter > 0 && now.Sub(c.updatedAt[obs]) > c.staleAfter
+}
+
+func (c *Controller) anyMeterStale(now time.Time) bool {
+	for _, obs := range meterValues {
+		if c.stale(obs, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tick should be called periodically. It wakes the control loop on purely
+// time-based transitions, which no sensor change would otherwise trigger.
+func (c *Controller) Tick(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Run every check - each one records its own transition.
+	changed := c.checkStaleness(now)
+	changed = c.checkGridServicesCooldown(now) || changed
+	changed = c.checkBudgetOverrideExpiry(now) || changed
+	changed = c.checkPriceStaleness(now) || changed
+	changed = c.checkBoostExpiry(now) || changed
+	changed = c.checkOffPeakTransition(now) || changed
+	changed = c.checkExportWindowTransition(now) || changed
+	changed = c.solarGatePending() || changed
+	changed = c.batteryProtectPending() || changed
+	changed = c.checkStartupGraceExpiry(now) || changed
+	if changed {
+		c.cond.Signal()
+	}
+}
+
+func (c *Controller) isPriceStale(now time.Time) bool {
+	return !c.seen(observedPrice) || now.Sub(c.updatedAt[observedPrice]) > c.priceMaxAge
+}
+
+// checkPriceStaleness reports whether the price just became stale (or fresh again).
+func (c *Controller) checkPriceStaleness(now time.Time) bool {
+	stale := c.isPriceStale(now)
+	if stale == c.priceStale {
+		return false
+	}
+
+	c.priceStale = stale
+	if stale && c.controllerStrategy == StrategyPrice {
+		log.Printf("No price update in %s, falling back to off-peak window", c.priceMaxAge)
+	}
+	return true
+}
+
+// checkStaleness reports whether meter readings just became stale (or fresh again).
+func (c *Controller) checkStaleness(now time.Time) bool {
+	stale := c.anyMeterStale(now)
+	if stale == c.metersStale {
+		return false
+	}
+
+	c.metersStale = stale
+	if stale {
+		log.Printf("Meter readings older than %s, pausing EV charging", c.staleAfter)
+	} else {
+		log.Printf("Meter readings fresh again, resuming EV control")
+	}
+	return true
+}
+
+// checkBudgetOverrideExpiry reports whether the manual budget override just expired.
+func (c *Controller) checkBudgetOverrideExpiry(now time.Time) bool {
+	if !c.budgetOverrideActive || c.budgetOverrideUntil.IsZero() || now.Before(c.budgetOverrideUntil) {
+		return false
+	}
+
+	c.budgetOverrideActive = false
+	log.Printf("Budget override expired, resuming strategy control")
+	return true
+}
+
+func (c *Controller) boostActive(now time.Time) bool {
+	return now.Before(c.boostUntil)
+}
+
+// checkBoostExpiry reports whether a boost just ended.
+func (c *Controller) checkBoostExpiry(now time.Time) bool {
+	if c.boostUntil.IsZero() || c.boostActive(now) {
+		return false
+	}
+
+	c.boostUntil = time.Time{}
+	log.Printf("Boost ended, resuming normal control")
+	return true
+}
+
+// SetBoost charges at full (temperature limited) speed for d, regardless of
+// strategy. A d of 0 cancels an active boost.
+func (c *Controller) SetBoost(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d <= 0 {
+		c.boostUntil = time.Time{}
+	} else {
+		c.boostUntil = c.now().Add(d)
+	}
+	c.cond.Signal()
+}
+
+// SetPeakWindow sets the peak rates window, in minutes since midnight. If
+// endMinute is before startMinute, the window wraps around midnight.
+func (c *Controller) SetPeakWindow(startMinute, endMinute int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.peakRatesStartMinute = startMinute
+	c.peakRatesEndMinute = endMinute
+	c.cond.Signal()
+}
+
+// SetExportWindow sets the export window, in minutes since midnight. If
+// endMinute is before startMinute, the window wraps around midnight.
+func (c *Controller) SetExportWindow(startMinute, endMinute int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.exportStartMinute = startMinute
+	c.exportEndMinute = endMinute
+	c.exportWindowSet = true
+	c.cond.Signal()
+}
+
+// ParseTimeWindow parses "HH:MM-HH:MM" into minutes since midnight.
+func ParseTimeWindow(s string) (startMinute, endMinute int64, err error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+
+	minute := func(hhmm string) (int64, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(hhmm))
+		if err != nil {
+			return 0, fmt.Errorf("expected HH:MM, got %q", hhmm)
+		}
+		return int64(t.Hour()*60 + t.Minute()), nil
+	}
+
+	if startMinute, err = minute(start); err != nil {
+		return 0, 0, err
+	}
+	if endMinute, err = minute(end); err != nil {
+		return 0, 0, err
+	}
+	if startMinute == endMinute {
+		return 0, 0, fmt.Errorf("%q: window is empty", s)
+	}
+	return startMinute, endMinute, nil
+}
+
+// ControllerConfig holds the parameters that can be changed while running.
+type ControllerConfig struct {
+	PeakStartMinute         int64
+	PeakEndMinute           int64
+	BatteryTargetPercent    float64
+	BatteryTargetHysteresis float64
+	SolarFloorW             float64
+	BaselineLoadW           float64
+}
+
+func (c *Controller) Config() ControllerConfig {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return ControllerConfig{
+		PeakStartMinute:         c.peakRatesStartMinute,
+		PeakEndMinute:           c.peakRatesEndMinute,
+		BatteryTargetPercent:    c.batteryTargetPercent,
+		BatteryTargetHysteresis: c.batteryTargetHysteresis,
+		SolarFloorW:             c.solarFloorW,
+		BaselineLoadW:           c.baselineLoadW,
+	}
+}
+
+// SetEVSEMinAmps sets the least current the EVSEs charge at, instead of the
+// built in minAmps.
+func (c *Controller) SetEVSEMinAmps(amps int32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if amps != c.evseMinAmps {
+		c.evseMinAmps = amps
+		c.cond.Signal()
+	}
+}
+
+// minChargeAmps returns the least current the EVSEs charge at.
+func (c *Controller) minChargeAmps() int32 {
+	if c.evseMinAmps > 0 {
+		return c.evseMinAmps
+	}
+	return minAmps
+}
+
+// SetEVSEMaxAmps caps the budget at the max current the EVSEs advertise,
+// instead of the built in maxAmps.
+func (c *Controller) SetEVSEMaxAmps(amps int32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if amps != c.evseMaxAmps {
+		c.evseMaxAmps = amps
+		c.cond.Signal()
+	}
+}
+
+// SetEVSECount sets how many EVSEs share the budget, so it can go up to the
+// combined maximum of all of them.
+func (c *Controller) SetEVSECount(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evseCount = int32(n)
+}
+
+// SetPhaseMaxAmps sets the per phase limit (like the main breaker rating) of
+// a three phase supply. The EV is then taken to charge from all three phases,
+// so every amp of charge current is 3 × volts W. 0 disables per phase limiting
+// and means a single phase supply.
+func (c *Controller) SetPhaseMaxAmps(amps float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.phaseMaxAmps = amps
+	c.cond.Signal()
+}
+
+// phaseLimitW returns the budget that keeps the most loaded phase under
+// phaseMaxAmps. The EV draws evenly from all three phases, and its current
+// is already part of the phase currents.
+func (c *Controller) phaseLimitW() (int32, bool) {
+	if c.phaseMaxAmps <= 0 || !c.seen(observedLoadPhases) {
+		return 0, false
+	}
+
+	var worstAmps float64
+	for _, amps := range c.loadPhaseAmps {
+		if amps > worstAmps {
+			worstAmps = amps
+		}
+	}
+
+	evAmps := c.phaseMaxAmps - worstAmps + float64(c.evseMilliAmp)/1000
+	if evAmps < 0 {
+		evAmps = 0
+	}
+	return int32(evAmps * float64(c.wattsPerAmp())), true
+}
+
+// SetStrategyRamp configures how long the budget takes to move to the new
+// strategy's value after a strategy change.
+func (c *Controller) SetStrategyRamp(down, up time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rampDown = down
+	c.rampUp = up
+}
+
+// SetBatteryProtect configures battery protection, which only applies during
+// peak hours. A dischargeW or duration of 0 disables it.
+func (c *Controller) SetBatteryProtect(dischargeW float64, duration time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.protectDischargeW = dischargeW
+	c.protectDuration = duration
+}
+
+// BatteryProtectActive reports whether battery protection is holding the
+// budget at 0.
+func (c *Controller) BatteryProtectActive() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.protectActive
+}
+
+// batteryProtectPending reports whether battery protection is timing a
+// change, which needs a recompute even if no sensor changes.
+func (c *Controller) batteryProtectPending() bool {
+	return !c.protectChangingFrom.IsZero()
+}
+
+// protectBattery updates and returns whether battery protection is active.
+// Called with lock held.
+func (c *Controller) protectBattery(now time.Time) bool {
+	if c.protectDischargeW <= 0 || c.protectDuration <= 0 || !c.seen(observedBattery) || c.isOffPeak(now) {
+		if c.protectActive {
+			log.Printf("Ending battery protection")
+		}
+		c.protectActive = false
+		c.protectChangingFrom = time.Time{}
+		return false
+	}
+
+	above := c.exportedBatteryW > c.protectDischargeW
+	switch {
+	case above == c.protectActive:
+		c.protectChangingFrom = time.Time{}
+	case c.protectChangingFrom.IsZero():
+		c.protectChangingFrom = now
+	case now.Sub(c.protectChangingFrom) >= c.protectDuration:
+		c.protectActive = above
+		c.protectChangingFrom = time.Time{}
+		if above {
+			log.Printf("Powerwall discharged more than %.0f W for %s, stopping EV charging", c.protectDischargeW, c.protectDuration)
+		} else {
+			log.Printf("Powerwall discharged less than %.0f W for %s, ending battery protection", c.protectDischargeW, c.protectDuration)
+		}
+	}
+	return c.protectActive
+}
+
+// SetSolarGate configures the solar start/stop gate. startDelay and stopDelay
+// of 0 disable it.
+func (c *Controller) SetSolarGate(startDelay, stopDelay, cooldown time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.solarStartDelay = startDelay
+	c.solarStopDelay = stopDelay
+	c.solarCooldown = cooldown
+}
+
+func (c *Controller) solarGateEnabled() bool {
+	return c.solarStartDelay > 0 || c.solarStopDelay > 0
+}
+
+// solarGatePending reports whether the gate is timing a start or stop, which
+// needs a recompute even if no sensor changes.
+func (c *Controller) solarGatePending() bool {
+	if !c.solarGateEnabled() {
+		return false
+	}
+	if c.solarGateOn {
+		return !c.solarBelowSince.IsZero()
+	}
+	return !c.solarAboveSince.IsZero()
+}
+
+// gateSolar applies the solar start/stop gate to a budget sized from solar.
+// ok is false while charging is held off. Called with lock held.
+func (c *Controller) gateSolar(budgetW int32, now time.Time) (gatedW int32, ok bool) {
+	if !c.solarGateEnabled() {
+		return budgetW, true
+	}
+
+	minW := c.wattsPerAmp() * c.minChargeAmps()
+	if budgetW >= minW {
+		c.solarBelowSince = time.Time{}
+		if c.solarAboveSince.IsZero() {
+			c.solarAboveSince = now
+		}
+	} else {
+		c.solarAboveSince = time.Time{}
+		if c.solarBelowSince.IsZero() {
+			c.solarBelowSince = now
+		}
+	}
+
+	if c.solarGateOn {
+		if c.solarBelowSince.IsZero() {
+			return budgetW, true
+		}
+		if now.Sub(c.solarBelowSince) < c.solarStopDelay {
+			// Ride out the dip at the minimum charge rate.
+			return minW, true
+		}
+		log.Printf("Solar below the minimum charge rate for %s, stopping EV charging", c.solarStopDelay)
+		c.solarGateOn = false
+		c.solarStoppedAt = now
+		return 0, false
+	}
+
+	if c.solarAboveSince.IsZero() || now.Sub(c.solarAboveSince) < c.solarStartDelay ||
+		(!c.solarStoppedAt.IsZero() && now.Sub(c.solarStoppedAt) < c.solarCooldown) {
+		return 0, false
+	}
+	log.Printf("Solar above the minimum charge rate for %s, starting EV charging", c.solarStartDelay)
+	c.solarGateOn = true
+	return budgetW, true
+}
+
+// SetStartupGrace holds off applying any budget for d from now, unless all
+// key sensors have reported before then, so control doesn't start from a
+// partial set of early readings.
+func (c *Controller) SetStartupGrace(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d <= 0 {
+		c.graceUntil = time.Time{}
+		return
+	}
+
+	// Tick wakes the loop once it's over.
+	c.graceUntil = c.now().Add(d)
+}
+
+// checkStartupGraceExpiry reports whether the startup grace period just ran
+// out.
+func (c *Controller) checkStartupGraceExpiry(now time.Time) bool {
+	if c.graceUntil.IsZero() || now.Before(c.graceUntil) {
+		return false
+	}
+
+	log.Printf("Startup grace period over, starting EV control")
+	c.graceUntil = time.Time{}
+	return true
+}
+
+// inStartupGrace reports whether the budget must not be applied yet. Called
+// with lock held.
+func (c *Controller) inStartupGrace(now time.Time) bool {
+	if c.graceUntil.IsZero() {
+		return false
+	}
+
+	if now.Before(c.graceUntil) && !c.seen(startupValues...) {
+		return true
+	}
+
+	log.Printf("Startup grace period over, starting EV control")
+	c.graceUntil = time.Time{}
+	return false
+}
+
+// SetSoftStart limits how fast the budget may rise (W per second) for d after
+// charging starts, for onboard chargers that fault on sudden current steps.
+// A rateW of 0 disables the soft start.
+func (c *Controller) SetSoftStart(rateW float64, d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.softStartRateW = rateW
+	c.softStartDuration = d
+}
+
+// scheduleWakeup re-runs singleLoop after rampStep, since nothing else wakes
+// it up while the inputs are steady. Called with lock held.
+func (c *Controller) scheduleWakeup() {
+	if c.rampWakeupPending {
+		return
+	}
+	c.rampWakeupPending = true
+	time.AfterFunc(rampStep, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.rampWakeupPending = false
+		c.cond.Signal()
+	})
+}
+
+// applySoftStart caps target while a soft start is in progress, starting one
+// if the budget is going from 0 to non-zero. Called with lock held.
+func (c *Controller) applySoftStart(target int32, now time.Time) int32 {
+	if c.softStartRateW <= 0 || target <= 0 {
+		c.softStartAt = time.Time{}
+		return target
+	}
+
+	if c.softStartAt.IsZero() {
+		if c.haveLastBudget && c.lastBudgetW > 0 {
+			// Already charging.
+			return target
+		}
+		c.softStartAt = now
+	}
+
+	elapsed := now.Sub(c.softStartAt)
+	// The first step already allows one second's worth of increase.
+	capW := int32(c.softStartRateW * (elapsed + rampStep).Seconds())
+	if elapsed >= c.softStartDuration || capW >= target {
+		c.softStartAt = time.Time{}
+		return target
+	}
+
+	c.scheduleWakeup()
+	return capW
+}
+
+// applyRamp returns the budget to apply while a strategy change ramp is in
+// progress, and target once it is done. Called with lock held.
+func (c *Controller) applyRamp(target int32, now time.Time) int32 {
+	if c.rampStart.IsZero() {
+		return target
+	}
+
+	d := c.rampUp
+	if target < c.rampFromW {
+		d = c.rampDown
+	}
+
+	elapsed := now.Sub(c.rampStart)
+	if elapsed >= d {
+		c.rampStart = time.Time{}
+		return target
+	}
+
+	c.scheduleWakeup()
+	return c.rampFromW + int32(float64(target-c.rampFromW)*float64(elapsed)/float64(d))
+}
+
+func (c *Controller) GetBudgetReason() BudgetReason {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.reason
+}
+
+// GetBoostRemaining returns how much longer the boost is active (0 if not).
+func (c *Controller) GetBoostRemaining(now time.Time) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.boostActive(now) {
+		return 0
+	}
+	return c.boostUntil.Sub(now)
+}
+
+// SetEnabled turns all EV budget control on or off.
+func (c *Controller) SetEnabled(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.disabled == !enabled {
+		return
+	}
+	c.disabled = !enabled
+	c.disabledParked = false
+	c.cond.Signal()
+}
+
+// Enabled reports whether EV budget control is on.
+func (c *Controller) Enabled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !c.disabled
+}
+
+// SetBudgetOverride makes the controller apply budgetW until the given time
+// (or indefinitely if until is zero), ignoring the strategy.
+func (c *Controller) SetBudgetOverride(budgetW int32, until time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.budgetOverrideActive = true
+	c.budgetOverrideW = budgetW
+	c.budgetOverrideUntil = until
+	c.cond.Signal()
+}
+
+func (c *Controller) ClearBudgetOverride() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.budgetOverrideActive {
+		c.budgetOverrideActive = false
+		c.cond.Signal()
+	}
+}
+
+// GetBudgetOverride returns the active override, if any.
+func (c *Controller) GetBudgetOverride() (budgetW int32, until time.Time, active bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.budgetOverrideW, c.budgetOverrideUntil, c.budgetOverrideActive
+}
+
+// checkGridServicesCooldown reports whether the post grid services cooldown just ended.
+func (c *Controller) checkGridServicesCooldown(now time.Time) bool {
+	if !c.gridServicesCooldownActive || c.inGridServicesCooldown(now) {
+		return false
+	}
+
+	c.gridServicesCooldownActive = false
+	log.Printf("Grid services cooldown over, resuming EV control")
+	return true
+}
+
+func (c *Controller) inGridServicesCooldown(now time.Time) bool {
+	return c.gridServicesCooldownActive && now.Sub(c.loadReductionEndedAt) < c.gridServicesCooldown
+}
+
+// Recompute wakes the control loop to recompute and apply the EV budget even if
+// no sensor value has changed.
+func (c *Controller) Recompute() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cond.Signal()
+}
+
+// ControllerState is a point-in-time copy of the controller's sensor values.
+type ControllerState struct {
+	SolarW                float64
+	LoadW                 float64
+	ExportedSolarW        float64
+	ExportedBatteryW      float64
+	PowerwallBatteryLevel float64
+	OperationMode         OperationMode
+	EVSETemp              Temperature
+	EVSEMilliAmp          int64
+	EVSEVolts             int32 // Measured if plausible, nominal otherwise
+	EVSEPhases            int32 // 3 on a three phase supply, 1 otherwise
+	EVConnected           ConnectedType
+}
+
+// State returns all sensor values under a single lock acquisition.
+func (c *Controller) State() ControllerState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return ControllerState{
+		SolarW:                c.solarW,
+		LoadW:                 c.loadW,
+		ExportedSolarW:        c.exportedSolarW,
+		ExportedBatteryW:      c.exportedBatteryW,
+		PowerwallBatteryLevel: c.pwBatteryLevelPercent,
+		OperationMode:         c.operationMode,
+		EVSETemp:              c.temp,
+		EVSEMilliAmp:          c.evseMilliAmp,
+		EVSEVolts:             c.effectiveVolts(),
+		EVSEPhases:            c.phases(),
+		EVConnected:           c.evConnected,
+	}
+}
+
+func (c *Controller) GetSolarW() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.solarW
+}
+
+func (c *Controller) GetLoadW() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.loadW
+}
+
+func (c *Controller) GetPowerwallBatteryLevel() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.pwBatteryLevelPercent
+}
+
+func (c *Controller) GetExportedSolarW() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.exportedSolarW
+}
+
+func (c *Controller) GetOperationMode() OperationMode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.operationMode
+}
+
+func (c *Controller) GetEVSETemp() Temperature {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.temp
+}
+
+func (c *Controller) GetEVSECurrent() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.evseMilliAmp
+}
+
+// TargetMilliAmp returns the EV current the last budget offers, or 0 if that
+// is below what the EVSE charges at. ok is false until a budget is applied.
+func (c *Controller) TargetMilliAmp() (milliAmp int64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.haveLastBudget {
+		return 0, false
+	}
+	milliAmp = int64(c.lastBudgetW) * 1000 / int64(c.wattsPerAmp())
+	if milliAmp < int64(c.minChargeAmps())*1000 {
+		return 0, true
+	}
+	return milliAmp, true
+}
+
+func (c *Controller) GetEVConnected() ConnectedType {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.evConnected
+}
+
+func (c *Controller) seen(checks ...observedValues) bool {
+	for _, check := range checks {
+		if c.seenValues&check != check {
+			return false
+		}
+	}
+
+	return true
+}
+
+// effectiveVolts returns the EVSE's measured voltage if it is plausible, and
+// the nominal volts otherwise.
+func (c *Controller) effectiveVolts() int32 {
+	if c.seen(observedEVVoltage) && c.evseVolts >= minValidVolts && c.evseVolts <= maxValidVolts {
+		return int32(c.evseVolts)
+	}
+	return volts
+}
+
+// phases returns how many phases the EV charges from.
+func (c *Controller) phases() int32 {
+	if c.phaseMaxAmps > 0 {
+		return 3
+	}
+	return 1
+}
+
+// wattsPerAmp converts the EV's charge current to power.
+func (c *Controller) wattsPerAmp() int32 {
+	return c.effectiveVolts() * c.phases()
+}
+
+// TempMaxAmps returns the per EVSE current limit the controller applies for
+// the EVSE temperature, including the cap while no reading is plausible.
+func (c *Controller) TempMaxAmps() int32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.seen(observedTemp) {
+		if c.tempImplausible {
+			return c.minChargeAmps()
+		}
+		return maxAmps
+	}
+	return MaxAmpsForTemp(c.temp, c.tempInterpolate)
+}
+
+// tempLimitedMaxPower is the most the EV may draw given the EVSE temperature.
+func (c *Controller) tempLimitedMaxPower() int32 {
+	if !c.seen(observedTemp) && c.tempImplausible {
+		// The EVSE has never reported a usable temperature. Don't assume it's cool.
+		return c.wattsPerAmp() * c.minChargeAmps() * c.evseCount
+	}
+
+	if c.seen(observedTemp) {
+		if maxPower := maxPowerForTemp(c.temp, c.wattsPerAmp(), c.tempInterpolate); maxPower != math.MaxInt32 {
+			// With several EVSEs, temp is the hottest one. Assume they're all as hot.
+			return maxPower * c.evseCount
+		}
+	}
+	return math.MaxInt32
+}
+
+func maxPowerForTemp(temp Temperature, wattsPerAmp int32, interpolate bool) int32 {
+	var maxPower int32 = math.MaxInt32
+
+	if amps := MaxAmpsForTemp(temp, interpolate); amps < maxAmps {
+		maxPower = wattsPerAmp * amps
+	}
+
+	return maxPower
+}
+
+// MaxAmpsForTemp returns the current limit from tempClamps, or maxAmps if the
+// EVSE is cool enough to not be derated. With interpolate, the limit falls
+// linearly from maxAmps 1C below the first clamp to each clamp's maxAmps at
+// its temperature, which is never more than the stepwise limit.
+func MaxAmpsForTemp(temp Temperature, interpolate bool) int32 {
+	if !interpolate {
+		for _, tempClamp := range tempClamps {
+			if temp > tempClamp.temp {
+				return tempClamp.maxAmps
+			}
+		}
+		return maxAmps
+	}
+
+	if temp >= tempClamps[0].temp {
+		return tempClamps[0].maxAmps
+	}
+
+	coolest := tempClamps[len(tempClamps)-1]
+	points := append(append([]tempClamp{}, tempClamps...), tempClamp{coolest.temp - Celsius, maxAmps})
+	for i := 1; i < len(points); i++ {
+		hotter, cooler := points[i-1], points[i]
+		if temp >= cooler.temp {
+			frac := float64(temp-cooler.temp) / float64(hotter.temp-cooler.temp)
+			return int32(float64(cooler.maxAmps) - frac*float64(cooler.maxAmps-hotter.maxAmps))
+		}
+	}
+	return maxAmps
+}
+
+// inWindow reports whether dayMinute is in [startMinute, endMinute), which
+// wraps around midnight if endMinute is before startMinute.
+func inWindow(dayMinute, startMinute, endMinute int64) bool {
+	if startMinute < endMinute {
+		return dayMinute >= startMinute && dayMinute < endMinute
+	}
+	// Wraps around midnight, like 22:00-02:00.
+	return dayMinute >= startMinute || dayMinute < endMinute
+}
+
+// dayMinute returns the minutes since midnight at t, in the controller's
+// time zone rather than the process's.
+func (c *Controller) dayMinute(t time.Time) int64 {
+	t = t.In(c.loc)
+	return int64(t.Hour()*60 + t.Minute())
+}
+
+func (c *Controller) isOffPeak(t time.Time) bool {
+	dayMinute := c.dayMinute(t)
+	return !inWindow(dayMinute, c.peakRatesStartMinute, c.peakRatesEndMinute)
+}
+
+func (c *Controller) isExportWindow(t time.Time) bool {
+	if !c.exportWindowSet {
+		return false
+	}
+
+	dayMinute := c.dayMinute(t)
+	return inWindow(dayMinute, c.exportStartMinute, c.exportEndMinute)
+}
+
+// checkExportWindowTransition reports whether the export window just started
+// or ended.
+func (c *Controller) checkExportWindowTransition(now time.Time) bool {
+	in := c.isExportWindow(now)
+	if in == c.inExportWindow {
+		return false
+	}
+
+	c.inExportWindow = in
+	return true
+}
+
+func (c *Controller) IsOffPeak(t time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.isOffPeak(t)
+}
+
+// checkOffPeakTransition reports whether the off-peak window just started or
+// ended, which changes the budget of time based strategies.
+func (c *Controller) checkOffPeakTransition(now time.Time) bool {
+	offPeak := c.isOffPeak(now)
+	if offPeak == c.offPeak {
+		return false
+	}
+
+	c.offPeak = offPeak
+	return true
+}
+
+// MinutesUntilOffPeak returns the number of minutes from t until the next
+// off-peak window starts, or 0 if t is already off-peak.
+func (c *Controller) MinutesUntilOffPeak(t time.Time) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isOffPeak(t) {
+		return 0
+	}
+
+	dayMinute := c.dayMinute(t)
+	// The peak window may wrap around midnight.
+	return (c.peakRatesEndMinute - dayMinute + 24*60) % (24 * 60)
+}
+
+// forecastMargin is how much more solar than strictly needed must be
+// forecast before trusting it to fill the Powerwall later in the day.
+const forecastMargin = 1.5
+
+func (c *Controller) forecastCoversBatteryTarget() bool {
+	if !c.seen(observedSolarForecast, observedPowerwallCapacity) {
+		return false
+	}
+
+	neededWh := (c.batteryTargetPercent - c.pwBatteryLevelPercent) / 100 * c.pwFullPackWh
+	return c.solarForecastRemainingWh >= neededWh*forecastMargin
+}
+
+// nearBackupReserve reports whether the Powerwall is at or below its backup
+// reserve plus reserveMarginPercent.
+func (c *Controller) nearBackupReserve() bool {
+	if c.reserveMarginPercent < 0 || !c.seen(observedBatteryLevel) || !c.seen(observedBackupReserve) {
+		return false
+	}
+	return c.pwBatteryLevelPercent <= c.backupReservePercent+c.reserveMarginPercent
+}
+
+// belowBatteryTarget reports whether the Powerwall should get solar priority
+// over the EV, applying hysteresis around the target.
+func (c *Controller) belowBatteryTarget() bool {
+	if !c.seen(observedBatteryLevel) {
+		// Don't know the level yet - favor the battery.
+		return true
+	}
+
+	if c.forecastCoversBatteryTarget() {
+		// Enough sun is still expected today to reach the target later, so the
+		// EV can have the excess now.
+		return false
+	}
+
+	switch {
+	case c.pwBatteryLevelPercent >= c.batteryTargetPercent:
+		c.batteryTargetReached = true
+	case c.pwBatteryLevelPercent < c.batteryTargetPercent-c.batteryTargetHysteresis:
+		c.batteryTargetReached = false
+	}
+
+	return !c.batteryTargetReached
+}
+
+// BudgetReason explains the most recent budget decision.
+type BudgetReason string
+
+const (
+	reasonNoData               BudgetReason = "waiting for data"
+	reasonBoost                BudgetReason = "boost"
+	reasonOverride             BudgetReason = "manual override"
+	reasonDataStale            BudgetReason = "Powerwall data stale"
+	reasonFullSpeed            BudgetReason = "full speed"
+	reasonTempDerate           BudgetReason = "temperature derate"
+	reasonOffPeak              BudgetReason = "off-peak"
+	reasonPeak                 BudgetReason = "peak hours"
+	reasonPriceLow             BudgetReason = "price below threshold"
+	reasonPriceHigh            BudgetReason = "price above threshold"
+	reasonLoadReduction        BudgetReason = "grid services active"
+	reasonGridServicesCooldown BudgetReason = "grid services cooldown"
+	reasonBatteryExporting     BudgetReason = "Powerwall discharging"
+	reasonBelowBatteryTarget   BudgetReason = "below battery target"
+	reasonMetersStale          BudgetReason = "meter data stale"
+	reasonGrossSolar           BudgetReason = "gross solar"
+	reasonExcessSolar          BudgetReason = "excess solar"
+	reasonNoMeterData          BudgetReason = "no meter data"
+	reasonEVTargetReached      BudgetReason = "EV target SOC reached"
+	reasonNearReserve          BudgetReason = "Powerwall near backup reserve"
+	reasonExportWindow         BudgetReason = "export window"
+	reasonEVDisconnected       BudgetReason = "EV disconnected"
+	reasonSolarGate            BudgetReason = "waiting for steady solar"
+	reasonDisabled             BudgetReason = "control disabled"
+	reasonBatteryProtect       BudgetReason = "protecting Powerwall"
+)
+
+// limitSolar applies the solar start/stop gate and the temperature limit to a
+// budget sized from solar.
+func (c *Controller) limitSolar(budget int32, reason BudgetReason, maxPower int32, now time.Time) (int32, BudgetReason) {
+	budget, ok := c.gateSolar(budget, now)
+	if !ok {
+		return 0, reasonSolarGate
+	}
+	return limitByTemp(budget, reason, maxPower)
+}
+
+// limitByTemp caps budget at the temperature limited max power.
+func limitByTemp(budget int32, reason BudgetReason, maxPower int32) (int32, BudgetReason) {
+	if maxPower < budget {
+		return maxPower, reasonTempDerate
+	}
+	return budget, reason
+}
+
+func (c *Controller) computeMaxPower() (int32, BudgetReason) {
+	now := c.now()
+
+	// Kept up to date even while something else decides the budget.
+	protectBattery := c.protectBattery(now)
+
+	if c.disabled {
+		return 0, reasonDisabled
+	}
+
+	if c.boostActive(now) {
+		// Boost overrides everything except the temperature derate.
+		return c.tempLimitedMaxPower(), reasonBoost
+	}
+
+	if c.budgetOverrideActive {
+		return c.budgetOverrideW, reasonOverride
+	}
+
+	if c.evTargetSOC > 0 && c.seen(observedEVSOC) && c.evSOC >= c.evTargetSOC {
+		// The EV is full enough, even if there's solar to spare.
+		return 0, reasonEVTargetReached
+	}
+
+	if c.zeroWhenDisconnected && c.seen(observedEVConnected) && !bool(c.evConnected) {
+		// Don't leave a stale budget published for the next car to start on.
+		return 0, reasonEVDisconnected
+	}
+
+	if c.isExportWindow(now) {
+		// Exports earn more than anything the EV could save.
+		return 0, reasonExportWindow
+	}
+
+	if !c.seen(observedStrategy) {
+		// Not enough data to make informed choices - try again when we have more data.
+		return math.MinInt32, reasonNoData
+	}
+
+	if c.dataStale {
+		return c.staleBudgetW, reasonDataStale
+	}
+
+	if protectBattery {
+		return 0, reasonBatteryProtect
+	}
+
+	if c.nearBackupReserve() {
+		timeBased := c.controllerStrategy == StrategyFullSpeed ||
+			c.controllerStrategy == StrategyOffpeak ||
+			c.controllerStrategy == StrategyPrice
+		if !timeBased || c.reserveMarginAllStrategies {
+			return 0, reasonNearReserve
+		}
+	}
+
+	maxPower := c.tempLimitedMaxPower()
+	fullSpeed := func(reason BudgetReason) (int32, BudgetReason) {
+		return limitByTemp(math.MaxInt32, reason, maxPower)
+	}
+
+	if c.controllerStrategy == StrategyFullSpeed {
+		return fullSpeed(reasonFullSpeed)
+	}
+
+	if c.controllerStrategy == StrategyOffpeak {
+		if c.isOffPeak(now) {
+			return fullSpeed(reasonOffPeak)
+		} else {
+			return 0, reasonPeak
+		}
+	}
+
+	if c.controllerStrategy == StrategyPrice {
+		if !c.isPriceStale(now) {
+			if c.price < c.priceThreshold {
+				return fullSpeed(reasonPriceLow)
+			}
+			return 0, reasonPriceHigh
+		}
+
+		// Without a recent price, behave like the offpeak strategy.
+		if c.isOffPeak(now) {
+			return fullSpeed(reasonOffPeak)
+		}
+		return 0, reasonPeak
+	}
+
+	// Load reduction is fairly high priority - it usually means bad weather (heatwave or storm).
+	// Don't try to charge during this time.
+	// It is up to the operator to manually charge at full speed before we're in bad weather.
+	if c.seen(observedLR) && c.loadReductionEnabled {
+		return 0, reasonLoadReduction
+	}
+
+	if c.inGridServicesCooldown(now) {
+		return 0, reasonGridServicesCooldown
+	}
+
+	if c.seen(observedBattery) && c.exportedBatteryW > 200 {
+		// If battery is exporting non-trivial power, shut off EV charging.
+		// This can happen if Tesla gateway is set to "timed based control".
+		// During peak period, solar gets exported to grid and battery exports
+		// to load. No point charging the EV during this time.
+		return 0, reasonBatteryExporting
+	}
+
+	if c.controllerStrategy == StrategyBatteryTarget && c.belowBatteryTarget() {
+		// Let solar top up the Powerwall first.
+		return 0, reasonBelowBatteryTarget
+	}
+
+	if c.anyMeterStale(now) {
+		// Don't size the budget from readings we haven't heard about in a while
+		// (e.g. the gateway is restarting).
+		return 0, reasonMetersStale
+	}
+
+	if c.solarFloorW > 0 && c.seen(observedSolar) && c.solarW >= c.solarFloorW {
+		// Production is high enough that the EV can soak up generation that the
+		// house would otherwise consume, even if net export is close to zero.
+		// Never offer less than what is actually being exported, though, like
+		// when the house uses less than baselineLoadW.
+		budgetW := c.solarW - c.baselineLoadW
+		if c.seen(observedExportedSolar) && c.exportedSolarW > budgetW {
+			budgetW = c.exportedSolarW
+		}
+		return c.limitSolar(int32(budgetW), reasonGrossSolar, maxPower, now)
+	}
+
+	if c.seen(observedExportedSolar) {
+		return c.limitSolar(int32(c.exportedSolarW), reasonExcessSolar, maxPower, now)
+	}
+
+	return fullSpeed(reasonNoMeterData)
+}
+
+func (c *Controller) singleLoop() error {
+	c.lock.Lock()
+	c.cond.Wait()
+
+	defer c.lock.Unlock()
+	return c.update()
+}
+
+// update computes the budget and applies it. Called with lock held.
+func (c *Controller) update() error {
+	maxPower, reason := c.computeMaxPower()
+	if reason != c.reason {
+		log.Printf("EV budget reason: %s -> %s", c.reason, reason)
+		c.reason = reason
+	}
+
+	if maxPower < minSitePowerW {
+		// Not enough data. Don't take action
+		return nil
+	}
+
+	if reason == reasonDisabled {
+		if c.disabledParked {
+			return nil
+		}
+		if c.inStartupGrace(c.now()) {
+			// Leave the EVSE alone until the grace period is over, then park it.
+			c.report(0, reason)
+			return nil
+		}
+		// Park the EVSE at 0 once. Re-enabling goes straight to the strategy's
+		// budget, through the soft start if there is one.
+		c.disabledParked = true
+		c.rampStart = time.Time{}
+		c.lastBudgetW = 0
+		c.haveLastBudget = true
+		c.report(0, reason)
+		return c.setEcoPowerLimit(0)
+	}
+
+	limitAmps := maxAmps * c.evseCount
+	if c.evseMaxAmps > 0 {
+		limitAmps = c.evseMaxAmps
+	}
+	if v := c.wattsPerAmp(); maxPower > v*limitAmps {
+		maxPower = v * limitAmps
+	}
+	if limitW, ok := c.phaseLimitW(); ok && maxPower > limitW {
+		maxPower = limitW
+	}
+
+	now := c.now()
+	if c.inStartupGrace(now) {
+		// Show what the budget would be, but leave the EVSE alone.
+		c.report(maxPower, reason)
+		return nil
+	}
+
+	if reason == reasonEVDisconnected {
+		// Drop to 0 right away instead of ramping down.
+		c.rampStart = time.Time{}
+	}
+	maxPower = c.applyRamp(maxPower, now)
+	maxPower = c.applySoftStart(maxPower, now)
+	c.lastBudgetW = maxPower
+	c.haveLastBudget = true
+	c.report(maxPower, reason)
+
+	return c.setEcoPowerLimit(maxPower)
+}
+
+// report passes a budget to the budget reporter, if any. Called with lock
+// held.
+func (c *Controller) report(budgetW int32, reason BudgetReason) {
+	if c.reportBudget != nil {
+		c.reportBudget(budgetW, reason)
+	}
+}
+
+func (c *Controller) Loop() error {
+	for {
+		if err := c.singleLoop(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,1407 @@
+package powerwall
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock for the controller.
+type testClock struct {
+	now time.Time
+}
+
+func (k *testClock) Now() time.Time { return k.now }
+
+func (k *testClock) Advance(d time.Duration) { k.now = k.now.Add(d) }
+
+// At moves the clock to hh:mm on the current day.
+func (k *testClock) At(hh, mm int) {
+	y, m, d := k.now.Date()
+	k.now = time.Date(y, m, d, hh, mm, 0, 0, k.now.Location())
+}
+
+// newTestController returns a controller whose clock starts at noon UTC,
+// outside the default 16:00-21:00 peak window. Budgets it applies are
+// appended to applied.
+func newTestController() (c *Controller, clock *testClock, applied *[]int32) {
+	applied = &[]int32{}
+	c = NewController(func(budgetW int32) error {
+		*applied = append(*applied, budgetW)
+		return nil
+	})
+	clock = &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	c.now = clock.Now
+	c.SetLocation(time.UTC)
+	return c, clock, applied
+}
+
+func computeBudget(c *Controller) (int32, BudgetReason) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.computeMaxPower()
+}
+
+// applyBudget runs one iteration of the control loop, without waiting for a
+// sensor change, and returns the budget passed to the EVSE. ok is false if
+// none was.
+func applyBudget(t *testing.T, c *Controller, applied *[]int32) (budgetW int32, ok bool) {
+	t.Helper()
+	n := len(*applied)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.update(); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if len(*applied) == n {
+		return 0, false
+	}
+	return (*applied)[len(*applied)-1], true
+}
+
+func TestComputeMaxPower(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		setup      func(c *Controller, clock *testClock)
+		wantW      int32
+		wantReason BudgetReason
+	}{
+		{
+			name:       "no strategy",
+			setup:      func(c *Controller, clock *testClock) {},
+			wantW:      math.MinInt32,
+			wantReason: reasonNoData,
+		},
+		{
+			name: "no strategy with meters",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetExportedSolarW(3000)
+				c.SetExportedBatteryW(0)
+			},
+			wantW:      math.MinInt32,
+			wantReason: reasonNoData,
+		},
+
+		// Full speed.
+		{
+			name: "fullspeed",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonFullSpeed,
+		},
+		{
+			name: "fullspeed ignores exports",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetExportedSolarW(-2000)
+				c.SetExportedBatteryW(3000)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonFullSpeed,
+		},
+		{
+			name: "fullspeed temperature derate",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEVSETemp(485)
+			},
+			wantW:      240 * 16,
+			wantReason: reasonTempDerate,
+		},
+		{
+			name: "fullspeed derate at measured voltage",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEVSETemp(485)
+				c.SetEVSEVoltage(230)
+			},
+			wantW:      230 * 16,
+			wantReason: reasonTempDerate,
+		},
+		{
+			name: "fullspeed derate at nominal voltage if measured is implausible",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEVSETemp(485)
+				c.SetEVSEVoltage(500)
+			},
+			wantW:      240 * 16,
+			wantReason: reasonTempDerate,
+		},
+		{
+			name: "fullspeed below derate temperature",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEVSETemp(455)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonFullSpeed,
+		},
+
+		// Off-peak.
+		{
+			name: "offpeak before peak",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyOffpeak)
+				clock.At(15, 59)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonOffPeak,
+		},
+		{
+			name: "offpeak at peak start",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyOffpeak)
+				clock.At(16, 0)
+			},
+			wantW:      0,
+			wantReason: reasonPeak,
+		},
+		{
+			name: "offpeak at peak end",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyOffpeak)
+				clock.At(21, 0)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonOffPeak,
+		},
+		{
+			name: "offpeak temperature derate",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyOffpeak)
+				c.SetEVSETemp(501)
+			},
+			wantW:      240 * 8,
+			wantReason: reasonTempDerate,
+		},
+
+		// Price.
+		{
+			name: "price below threshold",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyPrice)
+				c.SetPriceThreshold(0.20, time.Hour)
+				clock.At(17, 0)
+				c.SetPrice(0.10)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonPriceLow,
+		},
+		{
+			name: "price above threshold",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyPrice)
+				c.SetPriceThreshold(0.20, time.Hour)
+				c.SetPrice(0.30)
+			},
+			wantW:      0,
+			wantReason: reasonPriceHigh,
+		},
+		{
+			name: "price stale falls back to peak window",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyPrice)
+				c.SetPriceThreshold(0.20, time.Hour)
+				c.SetPrice(0.10)
+				clock.At(17, 0)
+			},
+			wantW:      0,
+			wantReason: reasonPeak,
+		},
+		{
+			name: "price never seen falls back to off-peak window",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyPrice)
+				c.SetPriceThreshold(0.20, time.Hour)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonOffPeak,
+		},
+
+		// Solar.
+		{
+			name: "solar exporting",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(2500)
+			},
+			wantW:      2500,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "solar importing",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(-500)
+			},
+			wantW:      -500,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "solar temperature derate",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(5000)
+				c.SetEVSETemp(485)
+			},
+			wantW:      240 * 16,
+			wantReason: reasonTempDerate,
+		},
+		{
+			name: "solar without meter data",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonNoMeterData,
+		},
+		{
+			name: "solar during load reduction",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(3000)
+				c.SetLoadReduction(true)
+			},
+			wantW:      0,
+			wantReason: reasonLoadReduction,
+		},
+		{
+			name: "solar while battery exporting",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(1000)
+				c.SetExportedBatteryW(500)
+			},
+			wantW:      0,
+			wantReason: reasonBatteryExporting,
+		},
+		{
+			name: "solar while battery exporting a little",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(1000)
+				c.SetExportedBatteryW(200)
+			},
+			wantW:      1000,
+			wantReason: reasonExcessSolar,
+		},
+
+		// Values that were never observed are ignored, whatever the field holds.
+		{
+			name: "battery export not observed",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(1000)
+				c.exportedBatteryW = 500
+			},
+			wantW:      1000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "load reduction not observed",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(1000)
+				c.loadReductionEnabled = true
+			},
+			wantW:      1000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "exported solar not observed",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.exportedSolarW = 1000
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonNoMeterData,
+		},
+		{
+			name: "temperature not observed",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.temp = 495
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonFullSpeed,
+		},
+		{
+			name: "battery level not observed",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyBatteryTarget)
+				c.SetBatteryTarget(80, 5)
+				c.SetExportedSolarW(2000)
+				c.pwBatteryLevelPercent = 95
+			},
+			wantW:      0,
+			wantReason: reasonBelowBatteryTarget,
+		},
+
+		// The operation mode is informational: the battery export check covers
+		// autonomous (time based control) mode carrying the house during peak.
+		{
+			name: "self-consumption with excess solar",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetOperationMode(OperationSelfConsumption)
+				c.SetExportedSolarW(2000)
+				c.SetExportedBatteryW(-1500)
+			},
+			wantW:      2000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "autonomous with excess solar",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetOperationMode(OperationAutonomous)
+				c.SetExportedSolarW(2000)
+				c.SetExportedBatteryW(0)
+			},
+			wantW:      2000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "autonomous exporting solar while the battery carries the house",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetOperationMode(OperationAutonomous)
+				c.SetExportedSolarW(1500)
+				c.SetExportedBatteryW(2000)
+			},
+			wantW:      0,
+			wantReason: reasonBatteryExporting,
+		},
+
+		// Battery target.
+		{
+			name: "battery target not reached",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyBatteryTarget)
+				c.SetBatteryTarget(80, 5)
+				c.SetPowerwallBatteryLevelPercent(50)
+				c.SetExportedSolarW(2000)
+			},
+			wantW:      0,
+			wantReason: reasonBelowBatteryTarget,
+		},
+		{
+			name: "battery target reached",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyBatteryTarget)
+				c.SetBatteryTarget(80, 5)
+				c.SetPowerwallBatteryLevelPercent(80)
+				c.SetExportedSolarW(2000)
+			},
+			wantW:      2000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "battery target covered by forecast",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyBatteryTarget)
+				c.SetBatteryTarget(80, 5)
+				c.SetPowerwallBatteryLevelPercent(60)
+				c.SetPowerwallFullPackWh(13500)
+				// 20% of 13.5 kWh is 2.7 kWh, times the 1.5 margin.
+				c.SetSolarForecastRemainingWh(4100)
+				c.SetExportedSolarW(2000)
+			},
+			wantW:      2000,
+			wantReason: reasonExcessSolar,
+		},
+
+		// Backup reserve margin.
+		{
+			name: "solar near backup reserve",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetReserveMargin(5, false)
+				c.SetBackupReservePercent(20)
+				c.SetPowerwallBatteryLevelPercent(25)
+				c.SetExportedSolarW(2000)
+			},
+			wantW:      0,
+			wantReason: reasonNearReserve,
+		},
+		{
+			name: "solar above backup reserve margin",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetReserveMargin(5, false)
+				c.SetBackupReservePercent(20)
+				c.SetPowerwallBatteryLevelPercent(25.5)
+				c.SetExportedSolarW(2000)
+			},
+			wantW:      2000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "fullspeed near backup reserve",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetReserveMargin(5, false)
+				c.SetBackupReservePercent(20)
+				c.SetPowerwallBatteryLevelPercent(21)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonFullSpeed,
+		},
+		{
+			name: "fullspeed near backup reserve, all strategies",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetReserveMargin(5, true)
+				c.SetBackupReservePercent(20)
+				c.SetPowerwallBatteryLevelPercent(21)
+			},
+			wantW:      0,
+			wantReason: reasonNearReserve,
+		},
+
+		// Staleness.
+		{
+			name: "Powerwall data stale",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(2000)
+				c.SetStaleBudget(1000)
+				c.SetDataStale(true)
+			},
+			wantW:      1000,
+			wantReason: reasonDataStale,
+		},
+		{
+			name: "meters stale",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetStaleAfter(time.Minute)
+				c.SetExportedSolarW(2000)
+				clock.Advance(61 * time.Second)
+			},
+			wantW:      0,
+			wantReason: reasonMetersStale,
+		},
+		{
+			name: "meters not yet stale",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetStaleAfter(time.Minute)
+				c.SetExportedSolarW(2000)
+				clock.Advance(59 * time.Second)
+			},
+			wantW:      2000,
+			wantReason: reasonExcessSolar,
+		},
+
+		// Overrides of the strategy.
+		{
+			name: "disabled",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEnabled(false)
+			},
+			wantW:      0,
+			wantReason: reasonDisabled,
+		},
+		{
+			name: "boost",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(-1000)
+				c.SetBoost(time.Hour)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonBoost,
+		},
+		{
+			name: "boost without strategy",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetBoost(time.Hour)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonBoost,
+		},
+		{
+			name: "boost temperature derate",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetEVSETemp(475)
+				c.SetBoost(time.Hour)
+			},
+			wantW:      240 * 24,
+			wantReason: reasonBoost,
+		},
+		{
+			name: "boost expired",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(-1000)
+				c.SetBoost(time.Hour)
+				clock.Advance(time.Hour)
+			},
+			wantW:      -1000,
+			wantReason: reasonExcessSolar,
+		},
+		{
+			name: "budget override",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategySolar)
+				c.SetExportedSolarW(5000)
+				c.SetBudgetOverride(1234, time.Time{})
+			},
+			wantW:      1234,
+			wantReason: reasonOverride,
+		},
+		{
+			name: "EV target SOC reached",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEVTargetSOC(80)
+				c.SetEVSOC(80)
+			},
+			wantW:      0,
+			wantReason: reasonEVTargetReached,
+		},
+		{
+			name: "EV target SOC not reached",
+			setup: func(c *Controller, clock *testClock) {
+				c.SetControllerStrategy(StrategyFullSpeed)
+				c.SetEVTargetSOC(80)
+				c.SetEVSOC(79)
+			},
+			wantW:      math.MaxInt32,
+			wantReason: reasonFullSpeed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, clock, _ := newTestController()
+			tc.setup(c, clock)
+
+			gotW, gotReason := computeBudget(c)
+			if gotW != tc.wantW || gotReason != tc.wantReason {
+				t.Errorf("computeMaxPower = %d (%s), want %d (%s)", gotW, gotReason, tc.wantW, tc.wantReason)
+			}
+		})
+	}
+}
+
+// Each setter must mark its own value as observed, and only that one.
+func TestSettersObserve(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(c *Controller)
+		want observedValues
+	}{
+		{"SetLoadW", func(c *Controller) { c.SetLoadW(1000) }, observedLoad},
+		{"SetOperationMode", func(c *Controller) { c.SetOperationMode(OperationAutonomous) }, observedOperationMode},
+		{"SetSolarW", func(c *Controller) { c.SetSolarW(1000) }, observedSolar},
+		{"SetExportedSolarW", func(c *Controller) { c.SetExportedSolarW(1000) }, observedExportedSolar},
+		{"SetExportedBatteryW", func(c *Controller) { c.SetExportedBatteryW(1000) }, observedBattery},
+		{"SetPowerwallBatteryLevelPercent", func(c *Controller) { c.SetPowerwallBatteryLevelPercent(50) }, observedBatteryLevel},
+		{"SetBackupReservePercent", func(c *Controller) { c.SetBackupReservePercent(20) }, observedBackupReserve},
+		{"SetLoadReduction", func(c *Controller) { c.SetLoadReduction(false) }, observedLR},
+		{"SetControllerStrategy", func(c *Controller) { c.SetControllerStrategy(StrategySolar) }, observedStrategy},
+		{"SetEVSETemp", func(c *Controller) { c.SetEVSETemp(300) }, observedTemp},
+		{"SetEVSECurrent", func(c *Controller) { c.SetEVSECurrent(8000) }, observedEVCurrent},
+		{"SetEVSEVoltage", func(c *Controller) { c.SetEVSEVoltage(240) }, observedEVVoltage},
+		{"SetEVConnected", func(c *Controller) { c.SetEVConnected(true) }, observedEVConnected},
+		{"SetLoadPhaseCurrents", func(c *Controller) { c.SetLoadPhaseCurrents([3]float64{1, 2, 3}) }, observedLoadPhases},
+	} {
+		c, _, _ := newTestController()
+		tc.set(c)
+		if c.seenValues != tc.want {
+			t.Errorf("%s observed %b, want %b", tc.name, c.seenValues, tc.want)
+		}
+	}
+}
+
+// The budget applied is never more than the EVSEs can draw.
+func TestUpdateCapsAtMaxAmps(t *testing.T) {
+	c, _, applied := newTestController()
+	if budgetW, ok := applyBudget(t, c, applied); ok {
+		t.Fatalf("applied %d W without a strategy", budgetW)
+	}
+
+	c.SetControllerStrategy(StrategyFullSpeed)
+	for _, tc := range []struct {
+		volts, evses int64
+		wantW        int32
+	}{
+		{0, 1, volts * maxAmps},
+		{230, 1, 230 * maxAmps},
+		{230, 2, 2 * 230 * maxAmps},
+	} {
+		if tc.volts != 0 {
+			c.SetEVSEVoltage(tc.volts)
+		}
+		c.SetEVSECount(int(tc.evses))
+		if budgetW, ok := applyBudget(t, c, applied); !ok || budgetW != tc.wantW {
+			t.Errorf("%d V, %d EVSEs: applied %d W (%t), want %d W", tc.volts, tc.evses, budgetW, ok, tc.wantW)
+		}
+	}
+}
+
+func TestGrossSolar(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		floorW, baselineW float64
+		solarW            float64
+		exportedW         *float64
+		wantW             int32
+		wantReason        BudgetReason
+	}{
+		{
+			name:   "net export without a floor",
+			solarW: 4000, exportedW: ptr(100.0),
+			wantW: 100, wantReason: reasonExcessSolar,
+		},
+		{
+			name:   "net export below the floor",
+			floorW: 2000, baselineW: 500,
+			solarW: 1500, exportedW: ptr(100.0),
+			wantW: 100, wantReason: reasonExcessSolar,
+		},
+		{
+			name:   "gross solar at the floor",
+			floorW: 2000, baselineW: 500,
+			solarW: 2000, exportedW: ptr(100.0),
+			wantW: 1500, wantReason: reasonGrossSolar,
+		},
+		{
+			name:   "gross solar while the house uses most of it",
+			floorW: 2000, baselineW: 500,
+			solarW: 4000, exportedW: ptr(100.0),
+			wantW: 3500, wantReason: reasonGrossSolar,
+		},
+		{
+			name:   "gross solar while the house uses less than the baseline",
+			floorW: 2000, baselineW: 500,
+			solarW: 4000, exportedW: ptr(3800.0),
+			wantW: 3800, wantReason: reasonGrossSolar,
+		},
+		{
+			name:   "gross solar without exported solar",
+			floorW: 2000, baselineW: 500,
+			solarW: 4000,
+			wantW:  3500, wantReason: reasonGrossSolar,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _, _ := newTestController()
+			c.SetControllerStrategy(StrategySolar)
+			c.SetSolarFloor(tc.floorW, tc.baselineW)
+			c.SetSolarW(tc.solarW)
+			if tc.exportedW != nil {
+				c.SetExportedSolarW(*tc.exportedW)
+			}
+
+			gotW, gotReason := computeBudget(c)
+			if gotW != tc.wantW || gotReason != tc.wantReason {
+				t.Errorf("computeMaxPower = %d (%s), want %d (%s)", gotW, gotReason, tc.wantW, tc.wantReason)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestGridServicesCooldown(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(2000)
+	c.SetGridServicesCooldown(30 * time.Minute)
+
+	check := func(step string, wantW int32, wantReason BudgetReason) {
+		t.Helper()
+		if gotW, gotReason := computeBudget(c); gotW != wantW || gotReason != wantReason {
+			t.Errorf("%s: computeMaxPower = %d (%s), want %d (%s)", step, gotW, gotReason, wantW, wantReason)
+		}
+	}
+
+	c.SetLoadReduction(false)
+	check("before the event", 2000, reasonExcessSolar)
+
+	c.SetLoadReduction(true)
+	check("during the event", 0, reasonLoadReduction)
+
+	clock.Advance(10 * time.Minute)
+	c.SetLoadReduction(false)
+	check("right after the event", 0, reasonGridServicesCooldown)
+
+	clock.Advance(30*time.Minute - time.Second)
+	check("just before the cooldown ends", 0, reasonGridServicesCooldown)
+
+	clock.Advance(time.Second)
+	c.Tick(clock.Now())
+	check("after the cooldown", 2000, reasonExcessSolar)
+
+	active, events := c.GridServicesToday(clock.Now())
+	if active != 10*time.Minute || events != 1 {
+		t.Errorf("GridServicesToday = %s, %d events, want 10m, 1 event", active, events)
+	}
+
+	// A second event starts the cooldown over.
+	c.SetLoadReduction(true)
+	clock.Advance(time.Minute)
+	c.SetLoadReduction(false)
+	clock.Advance(time.Minute)
+	check("after a second event", 0, reasonGridServicesCooldown)
+}
+
+func TestGridServicesNoCooldown(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(2000)
+
+	c.SetLoadReduction(true)
+	clock.Advance(10 * time.Minute)
+	c.SetLoadReduction(false)
+	if gotW, gotReason := computeBudget(c); gotW != 2000 || gotReason != reasonExcessSolar {
+		t.Errorf("computeMaxPower = %d (%s), want charging to resume right away", gotW, gotReason)
+	}
+}
+
+func TestImplausibleTemp(t *testing.T) {
+	c, _, _ := newTestController()
+	c.SetControllerStrategy(StrategyFullSpeed)
+
+	if got := c.TempMaxAmps(); got != maxAmps {
+		t.Errorf("TempMaxAmps before any reading = %d, want %d", got, maxAmps)
+	}
+
+	// A failed read decodes to 0 before there's ever been a good reading.
+	c.SetEVSETemp(0)
+	if gotW, gotReason := computeBudget(c); gotW != 240*minAmps || gotReason != reasonTempDerate {
+		t.Errorf("after a 0 reading: computeMaxPower = %d (%s), want %d (%s)", gotW, gotReason, 240*minAmps, reasonTempDerate)
+	}
+	if got := c.TempMaxAmps(); got != minAmps {
+		t.Errorf("TempMaxAmps after a 0 reading = %d, want %d", got, minAmps)
+	}
+
+	c.SetEVSETemp(485)
+	if gotW, _ := computeBudget(c); gotW != 240*16 {
+		t.Errorf("after a good reading: computeMaxPower = %d, want %d", gotW, 240*16)
+	}
+
+	// Later failed reads keep the last good temperature.
+	for _, temp := range []Temperature{0, -300} {
+		c.SetEVSETemp(temp)
+		if gotW, gotReason := computeBudget(c); gotW != 240*16 || gotReason != reasonTempDerate {
+			t.Errorf("after a %s reading: computeMaxPower = %d (%s), want %d (%s)", temp, gotW, gotReason, 240*16, reasonTempDerate)
+		}
+		if got := c.TempMaxAmps(); got != 16 {
+			t.Errorf("TempMaxAmps after a %s reading = %d, want 16", temp, got)
+		}
+	}
+
+	c.SetEVSETemp(300)
+	if gotW, gotReason := computeBudget(c); gotW != math.MaxInt32 || gotReason != reasonFullSpeed {
+		t.Errorf("after a cool reading: computeMaxPower = %d (%s), want full speed", gotW, gotReason)
+	}
+}
+
+func TestSoftStart(t *testing.T) {
+	c, clock, applied := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetSoftStart(500, 5*time.Second)
+
+	check := func(step string, wantW int32) {
+		t.Helper()
+		if gotW, ok := applyBudget(t, c, applied); !ok || gotW != wantW {
+			t.Errorf("%s: applied %d (ok=%t), want %d", step, gotW, ok, wantW)
+		}
+	}
+
+	// Cold start: the budget rises by 500 W/s, starting with one second's worth.
+	c.SetExportedSolarW(5000)
+	check("start", 500)
+	clock.Advance(time.Second)
+	check("after 1s", 1000)
+	clock.Advance(3 * time.Second)
+	check("after 4s", 2500)
+	clock.Advance(time.Second)
+	check("after the soft start", 5000)
+
+	// Once charging, increases aren't limited.
+	c.SetExportedSolarW(2000)
+	check("drop", 2000)
+	c.SetExportedSolarW(6000)
+	check("rise while charging", 6000)
+
+	// Going back to 0 makes the next start a cold one.
+	c.SetExportedSolarW(0)
+	check("stop", 0)
+	clock.Advance(time.Minute)
+	c.SetExportedSolarW(3000)
+	check("restart", 500)
+
+	// The soft start ends early once the cap reaches the target.
+	clock.Advance(5*time.Second - time.Millisecond)
+	c.SetExportedSolarW(1200)
+	check("target below the cap", 1200)
+	c.SetExportedSolarW(4000)
+	check("rise after the soft start ended", 4000)
+}
+
+func TestSoftStartDisabled(t *testing.T) {
+	c, _, applied := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(5000)
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 5000 {
+		t.Errorf("applied %d (ok=%t), want 5000 with no soft start", gotW, ok)
+	}
+}
+
+func TestExportWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		strategy   Strategy
+		window     [2]int64 // Start and end minute
+		hh, mm     int
+		wantW      int32
+		wantReason BudgetReason
+	}{
+		{"before start", StrategySolar, [2]int64{15 * 60, 17 * 60}, 14, 59, 2000, reasonExcessSolar},
+		{"at start", StrategySolar, [2]int64{15 * 60, 17 * 60}, 15, 0, 0, reasonExportWindow},
+		{"before end", StrategySolar, [2]int64{15 * 60, 17 * 60}, 16, 59, 0, reasonExportWindow},
+		{"at end", StrategySolar, [2]int64{15 * 60, 17 * 60}, 17, 0, 2000, reasonExcessSolar},
+
+		{"wrapping, before midnight", StrategySolar, [2]int64{23 * 60, 60}, 23, 30, 0, reasonExportWindow},
+		{"wrapping, after midnight", StrategySolar, [2]int64{23 * 60, 60}, 0, 30, 0, reasonExportWindow},
+		{"wrapping, at end", StrategySolar, [2]int64{23 * 60, 60}, 1, 0, 2000, reasonExcessSolar},
+		{"wrapping, midday", StrategySolar, [2]int64{23 * 60, 60}, 12, 0, 2000, reasonExcessSolar},
+
+		// The peak window is 16:00-21:00.
+		{"offpeak, window before peak", StrategyOffpeak, [2]int64{15 * 60, 17 * 60}, 15, 30, 0, reasonExportWindow},
+		{"offpeak, window overlapping peak", StrategyOffpeak, [2]int64{15 * 60, 17 * 60}, 16, 30, 0, reasonExportWindow},
+		{"offpeak, peak after window", StrategyOffpeak, [2]int64{15 * 60, 17 * 60}, 17, 0, 0, reasonPeak},
+		{"offpeak, after peak", StrategyOffpeak, [2]int64{15 * 60, 17 * 60}, 21, 0, math.MaxInt32, reasonOffPeak},
+		{"fullspeed, in window", StrategyFullSpeed, [2]int64{15 * 60, 17 * 60}, 15, 0, 0, reasonExportWindow},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, clock, _ := newTestController()
+			c.SetControllerStrategy(tc.strategy)
+			c.SetExportedSolarW(2000)
+			c.SetExportWindow(tc.window[0], tc.window[1])
+			clock.At(tc.hh, tc.mm)
+
+			gotW, gotReason := computeBudget(c)
+			if gotW != tc.wantW || gotReason != tc.wantReason {
+				t.Errorf("computeMaxPower = %d (%s), want %d (%s)", gotW, gotReason, tc.wantW, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestExportWindowTransition(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetExportWindow(15*60, 17*60)
+
+	transition := func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.checkExportWindowTransition(clock.Now())
+	}
+
+	for _, step := range []struct {
+		hh, mm int
+		want   bool
+	}{
+		{14, 59, false},
+		{15, 0, true},
+		{16, 0, false},
+		{17, 0, true},
+		{17, 1, false},
+	} {
+		clock.At(step.hh, step.mm)
+		if got := transition(); got != step.want {
+			t.Errorf("at %02d:%02d: checkExportWindowTransition = %t, want %t", step.hh, step.mm, got, step.want)
+		}
+	}
+}
+
+func TestMaxAmpsForTemp(t *testing.T) {
+	for _, tc := range []struct {
+		temp                     Temperature
+		wantStepwise, wantInterp int32
+	}{
+		{30 * Celsius, maxAmps, maxAmps},
+		{45 * Celsius, maxAmps, maxAmps},
+		{455, maxAmps, 36}, // Midway from 45C (no derate) to 46C (32A)
+		{46 * Celsius, maxAmps, 32},
+		{465, 32, 28},
+		{475, 24, 20},
+		{485, 16, 14},
+		{495, 12, 10},
+		{50 * Celsius, 12, 8},
+		{501, 8, 8},
+		{60 * Celsius, 8, 8},
+	} {
+		if got := MaxAmpsForTemp(tc.temp, false); got != tc.wantStepwise {
+			t.Errorf("MaxAmpsForTemp(%s, false) = %d, want %d", tc.temp, got, tc.wantStepwise)
+		}
+		if got := MaxAmpsForTemp(tc.temp, true); got != tc.wantInterp {
+			t.Errorf("MaxAmpsForTemp(%s, true) = %d, want %d", tc.temp, got, tc.wantInterp)
+		}
+		if interp, stepwise := MaxAmpsForTemp(tc.temp, true), MaxAmpsForTemp(tc.temp, false); interp > stepwise {
+			t.Errorf("at %s, interpolated limit %d is above the stepwise %d", tc.temp, interp, stepwise)
+		}
+	}
+}
+
+func TestTempInterpolateBudget(t *testing.T) {
+	c, _, _ := newTestController()
+	c.SetControllerStrategy(StrategyFullSpeed)
+	c.SetTempInterpolate(true)
+	c.SetEVSETemp(455)
+
+	if gotW, gotReason := computeBudget(c); gotW != 240*36 || gotReason != reasonTempDerate {
+		t.Errorf("computeMaxPower = %d (%s), want %d (%s)", gotW, gotReason, 240*36, reasonTempDerate)
+	}
+}
+
+func TestZeroBudgetWhenDisconnected(t *testing.T) {
+	c, _, applied := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(2000)
+	c.SetZeroBudgetWhenDisconnected(true)
+
+	for _, step := range []struct {
+		name       string
+		connected  ConnectedType
+		wantW      int32
+		wantReason BudgetReason
+	}{
+		{"connect", true, 2000, reasonExcessSolar},
+		{"disconnect", false, 0, reasonEVDisconnected},
+		{"reconnect", true, 2000, reasonExcessSolar},
+	} {
+		c.SetEVConnected(step.connected)
+		gotW, ok := applyBudget(t, c, applied)
+		if !ok || gotW != step.wantW || c.reason != step.wantReason {
+			t.Errorf("%s: applied %d (%s, ok=%t), want %d (%s)", step.name, gotW, c.reason, ok, step.wantW, step.wantReason)
+		}
+	}
+
+	c.SetZeroBudgetWhenDisconnected(false)
+	c.SetEVConnected(false)
+	if gotW, gotReason := computeBudget(c); gotW != 2000 || gotReason != reasonExcessSolar {
+		t.Errorf("disabled: computeMaxPower = %d (%s), want the budget to stay published", gotW, gotReason)
+	}
+}
+
+func TestSolarGate(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetSolarGate(2*time.Minute, time.Minute, 5*time.Minute)
+	start := clock.Now()
+
+	const minW = 240 * minAmps
+	for _, step := range []struct {
+		at         time.Duration
+		exportedW  float64
+		wantW      int32
+		wantReason BudgetReason
+	}{
+		{0, 2500, 0, reasonSolarGate},
+		{30 * time.Second, 1000, 0, reasonSolarGate}, // A dip restarts the start delay
+		{60 * time.Second, 2500, 0, reasonSolarGate},
+		{150 * time.Second, 2500, 0, reasonSolarGate},
+		{180 * time.Second, 2500, 2500, reasonExcessSolar}, // Above the minimum for 2m
+		{210 * time.Second, 1000, minW, reasonExcessSolar}, // Short dips are held at the minimum
+		{240 * time.Second, 2500, 2500, reasonExcessSolar},
+		{270 * time.Second, 1000, minW, reasonExcessSolar},
+		{300 * time.Second, 1500, minW, reasonExcessSolar},
+		{330 * time.Second, 1000, 0, reasonSolarGate},      // Below the minimum for 1m
+		{360 * time.Second, 3000, 0, reasonSolarGate},      // Start delay
+		{480 * time.Second, 3000, 0, reasonSolarGate},      // Past the start delay, but in the cooldown
+		{630 * time.Second, 3000, 3000, reasonExcessSolar}, // 5m after stopping
+	} {
+		clock.now = start.Add(step.at)
+		c.SetExportedSolarW(step.exportedW)
+		if gotW, gotReason := computeBudget(c); gotW != step.wantW || gotReason != step.wantReason {
+			t.Errorf("at %s with %.0f W: computeMaxPower = %d (%s), want %d (%s)", step.at, step.exportedW, gotW, gotReason, step.wantW, step.wantReason)
+		}
+	}
+}
+
+func TestSolarGatePending(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetSolarGate(time.Minute, time.Minute, 0)
+
+	pending := func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.solarGatePending()
+	}
+
+	c.SetExportedSolarW(1000)
+	computeBudget(c)
+	if pending() {
+		t.Error("pending while below the minimum with the gate off")
+	}
+
+	c.SetExportedSolarW(2500)
+	computeBudget(c)
+	if !pending() {
+		t.Error("not pending while timing a start")
+	}
+
+	clock.Advance(time.Minute)
+	computeBudget(c)
+	if pending() {
+		t.Error("pending after starting with steady solar")
+	}
+}
+
+func TestBatteryProtect(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategyFullSpeed)
+	c.SetBatteryProtect(1000, 10*time.Minute)
+	clock.At(17, 0) // Peak
+	start := clock.Now()
+
+	for _, step := range []struct {
+		at          time.Duration
+		dischargeW  float64
+		wantProtect bool
+	}{
+		{0, 3000, false},
+		{4 * time.Minute, 500, false}, // A dip restarts the timer
+		{6 * time.Minute, 3000, false},
+		{14 * time.Minute, 3000, false},
+		{16 * time.Minute, 3000, true}, // Above 1000 W for 10m
+		{18 * time.Minute, 200, true},
+		{24 * time.Minute, 3000, true}, // A spike restarts the timer
+		{26 * time.Minute, 200, true},
+		{35 * time.Minute, 200, true},
+		{36 * time.Minute, 200, false}, // Below 1000 W for 10m
+	} {
+		clock.now = start.Add(step.at)
+		c.SetExportedBatteryW(step.dischargeW)
+
+		wantW, wantReason := int32(math.MaxInt32), reasonFullSpeed
+		if step.wantProtect {
+			wantW, wantReason = 0, reasonBatteryProtect
+		}
+		if gotW, gotReason := computeBudget(c); gotW != wantW || gotReason != wantReason {
+			t.Errorf("at +%s with %.0f W: computeMaxPower = %d (%s), want %d (%s)", step.at, step.dischargeW, gotW, gotReason, wantW, wantReason)
+		}
+		if got := c.BatteryProtectActive(); got != step.wantProtect {
+			t.Errorf("at +%s: BatteryProtectActive = %t, want %t", step.at, got, step.wantProtect)
+		}
+	}
+}
+
+func TestBatteryProtectPeakOnly(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategyFullSpeed)
+	c.SetBatteryProtect(1000, 10*time.Minute)
+	c.SetExportedBatteryW(3000)
+
+	// Discharging all evening off-peak doesn't stop charging.
+	clock.At(22, 0)
+	for i := 0; i < 6; i++ {
+		computeBudget(c)
+		clock.Advance(5 * time.Minute)
+	}
+	if _, gotReason := computeBudget(c); gotReason != reasonFullSpeed {
+		t.Errorf("off-peak: reason = %s, want %s", gotReason, reasonFullSpeed)
+	}
+
+	// Protection started during peak ends with it.
+	clock.At(20, 40)
+	computeBudget(c)
+	clock.At(20, 50)
+	if _, gotReason := computeBudget(c); gotReason != reasonBatteryProtect {
+		t.Fatalf("peak: reason = %s, want %s", gotReason, reasonBatteryProtect)
+	}
+	clock.At(21, 0)
+	if _, gotReason := computeBudget(c); gotReason != reasonFullSpeed || c.BatteryProtectActive() {
+		t.Errorf("after peak: reason = %s, want protection to end", gotReason)
+	}
+}
+
+func TestPeakWindowWrapsMidnight(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategyOffpeak)
+	c.SetPeakWindow(22*60, 2*60)
+
+	for _, tc := range []struct {
+		hh, mm      int
+		wantOffPeak bool
+		wantMinutes int64
+	}{
+		{21, 59, true, 0},
+		{22, 0, false, 240},
+		{23, 30, false, 150},
+		{0, 0, false, 120},
+		{1, 59, false, 1},
+		{2, 0, true, 0},
+		{12, 0, true, 0},
+	} {
+		clock.At(tc.hh, tc.mm)
+		if got := c.IsOffPeak(clock.Now()); got != tc.wantOffPeak {
+			t.Errorf("at %02d:%02d: IsOffPeak = %t, want %t", tc.hh, tc.mm, got, tc.wantOffPeak)
+		}
+		if got := c.MinutesUntilOffPeak(clock.Now()); got != tc.wantMinutes {
+			t.Errorf("at %02d:%02d: MinutesUntilOffPeak = %d, want %d", tc.hh, tc.mm, got, tc.wantMinutes)
+		}
+		wantReason := reasonOffPeak
+		if !tc.wantOffPeak {
+			wantReason = reasonPeak
+		}
+		if _, gotReason := computeBudget(c); gotReason != wantReason {
+			t.Errorf("at %02d:%02d: reason = %s, want %s", tc.hh, tc.mm, gotReason, wantReason)
+		}
+	}
+}
+
+func TestWindowsUseLocation(t *testing.T) {
+	c, clock, _ := newTestController()
+	c.SetControllerStrategy(StrategyOffpeak)
+	c.SetLocation(time.FixedZone("PDT", -7*60*60))
+	c.SetExportWindow(14*60, 15*60)
+
+	for _, tc := range []struct {
+		hh, mm     int // UTC
+		wantReason BudgetReason
+	}{
+		{16, 30, reasonOffPeak},      // 09:30 local, peak in UTC
+		{21, 30, reasonExportWindow}, // 14:30 local
+		{23, 0, reasonPeak},          // 16:00 local
+		{3, 59, reasonPeak},          // 20:59 local, the day before
+		{4, 0, reasonOffPeak},        // 21:00 local
+	} {
+		clock.At(tc.hh, tc.mm)
+		if _, gotReason := computeBudget(c); gotReason != tc.wantReason {
+			t.Errorf("at %02d:%02d UTC: reason = %s, want %s", tc.hh, tc.mm, gotReason, tc.wantReason)
+		}
+	}
+}
+
+func TestControllerEVSEMinAmps(t *testing.T) {
+	c, _, _ := newTestController()
+	c.SetControllerStrategy(StrategyFullSpeed)
+	c.SetEVSEMinAmps(6)
+	c.SetEVSETemp(0)
+
+	if got := c.TempMaxAmps(); got != 6 {
+		t.Errorf("TempMaxAmps without a plausible temperature = %d, want the EVSE's 6 A minimum", got)
+	}
+	if gotW, _ := computeBudget(c); gotW != 240*6 {
+		t.Errorf("computeMaxPower = %d, want %d", gotW, 240*6)
+	}
+}
+
+func TestThreePhase(t *testing.T) {
+	c, _, applied := newTestController()
+	c.SetControllerStrategy(StrategyFullSpeed)
+	c.SetPhaseMaxAmps(63)
+
+	if got := c.State().EVSEPhases; got != 3 {
+		t.Errorf("EVSEPhases = %d, want 3", got)
+	}
+
+	c.SetEVSETemp(485)
+	if gotW, gotReason := computeBudget(c); gotW != 3*240*16 || gotReason != reasonTempDerate {
+		t.Errorf("derated: computeMaxPower = %d (%s), want %d", gotW, gotReason, 3*240*16)
+	}
+
+	// The EV's 10 A is part of the 40 A on the busiest phase, so it may draw 33 A.
+	c.SetEVSETemp(300)
+	c.SetEVSECurrent(10000)
+	c.SetLoadPhaseCurrents([3]float64{40, 20, 20})
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 3*240*33 {
+		t.Errorf("phase limited: applied %d (ok=%t), want %d", gotW, ok, 3*240*33)
+	}
+
+	c.SetLoadPhaseCurrents([3]float64{10, 10, 10})
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 3*240*maxAmps {
+		t.Errorf("EVSE limited: applied %d (ok=%t), want %d", gotW, ok, 3*240*maxAmps)
+	}
+}
+
+func TestThreePhaseSolarMinimum(t *testing.T) {
+	c, _, _ := newTestController()
+	c.SetControllerStrategy(StrategySolar)
+	c.SetPhaseMaxAmps(63)
+	c.SetSolarGate(time.Minute, time.Minute, 0)
+
+	// Enough for a single phase EV, but not three phases at the minimum current.
+	c.SetExportedSolarW(3000)
+	computeBudget(c)
+	c.lock.Lock()
+	pending := c.solarGatePending()
+	c.lock.Unlock()
+	if pending {
+		t.Errorf("solar gate timing a start below the three phase minimum of %d W", 3*240*minAmps)
+	}
+}
+
+func TestBudgetReporter(t *testing.T) {
+	c, clock, applied := newTestController()
+	type report struct {
+		budgetW int32
+		reason  BudgetReason
+	}
+	var reports []report
+	c.SetBudgetReporter(func(budgetW int32, reason BudgetReason) {
+		reports = append(reports, report{budgetW, reason})
+	})
+	lastReport := func() report {
+		if len(reports) == 0 {
+			return report{math.MinInt32, ""}
+		}
+		return reports[len(reports)-1]
+	}
+
+	c.SetStartupGrace(5 * time.Minute)
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(2000)
+
+	// During the grace period the budget is reported, but not applied.
+	if gotW, ok := applyBudget(t, c, applied); ok {
+		t.Errorf("during grace: applied %d", gotW)
+	}
+	if got, want := lastReport(), (report{2000, reasonExcessSolar}); got != want {
+		t.Errorf("during grace: reported %+v, want %+v", got, want)
+	}
+
+	clock.Advance(5 * time.Minute)
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 2000 {
+		t.Errorf("after grace: applied %d (ok=%t), want 2000", gotW, ok)
+	}
+	if got, want := lastReport(), (report{2000, reasonExcessSolar}); got != want || len(reports) != 2 {
+		t.Errorf("after grace: reported %+v (%d reports), want %+v", got, len(reports), want)
+	}
+
+	// Disabling parks the EVSE at 0 once.
+	c.SetEnabled(false)
+	for i := 0; i < 2; i++ {
+		applyBudget(t, c, applied)
+	}
+	if got, want := lastReport(), (report{0, reasonDisabled}); got != want || len(reports) != 3 {
+		t.Errorf("disabled: reported %+v (%d reports), want %+v once", got, len(reports), want)
+	}
+	if got := (*applied)[len(*applied)-1]; got != 0 {
+		t.Errorf("disabled: applied %d, want 0", got)
+	}
+}
+
+func TestStartupGrace(t *testing.T) {
+	c, clock, applied := newTestController()
+	c.SetStartupGrace(5 * time.Minute)
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(2000)
+
+	clock.Advance(5*time.Minute - time.Second)
+	c.Tick(clock.Now())
+	if gotW, ok := applyBudget(t, c, applied); ok {
+		t.Errorf("during grace: applied %d", gotW)
+	}
+
+	// Tick ends the grace period on the controller's clock.
+	clock.Advance(time.Second)
+	c.Tick(clock.Now())
+	if !c.graceUntil.IsZero() {
+		t.Errorf("grace period still on after Tick at its end")
+	}
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 2000 {
+		t.Errorf("after grace: applied %d (ok=%t), want 2000", gotW, ok)
+	}
+}
+
+func TestStartupGraceAllSeen(t *testing.T) {
+	c, _, applied := newTestController()
+	c.SetStartupGrace(5 * time.Minute)
+	c.SetControllerStrategy(StrategySolar)
+	c.SetExportedSolarW(2000)
+	c.SetSolarW(3000)
+	c.SetLoadW(1000)
+	c.SetExportedBatteryW(0)
+	c.SetPowerwallBatteryLevelPercent(80)
+	c.SetOperationMode(OperationSelfConsumption)
+	if gotW, ok := applyBudget(t, c, applied); ok {
+		t.Errorf("before load reduction was seen: applied %d", gotW)
+	}
+
+	// Everything has reported, so there's no need to wait any longer.
+	c.SetLoadReduction(false)
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 2000 {
+		t.Errorf("after all values were seen: applied %d (ok=%t), want 2000", gotW, ok)
+	}
+}
+
+func TestDisableEnable(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		softStartW   float64
+		afterEnableW []int32 // Applied on each second after enabling
+	}{
+		{"no soft start", 0, []int32{2000, 2000}},
+		{"soft start", 500, []int32{500, 1000, 1500, 2000}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, clock, applied := newTestController()
+			c.SetSoftStart(tc.softStartW, time.Minute)
+			c.SetControllerStrategy(StrategySolar)
+			c.SetExportedSolarW(2000)
+			for i := 0; i < 10; i++ {
+				applyBudget(t, c, applied)
+				clock.Advance(time.Second)
+			}
+			if got := (*applied)[len(*applied)-1]; got != 2000 {
+				t.Fatalf("before disabling: applied %d, want 2000", got)
+			}
+
+			c.SetEnabled(false)
+			if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 0 {
+				t.Errorf("disabled: applied %d (ok=%t), want 0", gotW, ok)
+			}
+			if gotW, ok := applyBudget(t, c, applied); ok {
+				t.Errorf("disabled again: applied %d, want the EVSE left alone", gotW)
+			}
+
+			c.SetEnabled(true)
+			for i, wantW := range tc.afterEnableW {
+				if gotW, ok := applyBudget(t, c, applied); !ok || gotW != wantW {
+					t.Errorf("%s after enabling: applied %d (ok=%t), want %d", time.Duration(i)*time.Second, gotW, ok, wantW)
+				}
+				clock.Advance(time.Second)
+			}
+		})
+	}
+}
+
+// Disabling during the startup grace period mustn't write to the EVSE until
+// the grace period is over.
+func TestDisabledDuringStartupGrace(t *testing.T) {
+	c, clock, applied := newTestController()
+	var reported []BudgetReason
+	c.SetBudgetReporter(func(budgetW int32, reason BudgetReason) {
+		reported = append(reported, reason)
+	})
+	c.SetStartupGrace(5 * time.Minute)
+	c.SetControllerStrategy(StrategySolar)
+	c.SetEnabled(false)
+
+	if gotW, ok := applyBudget(t, c, applied); ok {
+		t.Errorf("during grace: applied %d", gotW)
+	}
+	if len(reported) == 0 || reported[len(reported)-1] != reasonDisabled {
+		t.Errorf("during grace: reported %v, want %s", reported, reasonDisabled)
+	}
+
+	clock.Advance(5 * time.Minute)
+	c.Tick(clock.Now())
+	if gotW, ok := applyBudget(t, c, applied); !ok || gotW != 0 {
+		t.Errorf("after grace: applied %d (ok=%t), want 0", gotW, ok)
+	}
+}
@@ -0,0 +1,222 @@
+package powerwall
+
+import "sync"
+
+// EVSEFleet combines the status of all configured EVSEs. The controller sees
+// them as a single EVSE, and the budget it computes is split between them.
+type EVSEFleet struct {
+	lock  sync.Mutex
+	evses []evseState
+
+	// Match the controller's temperature derate and power model when
+	// splitting the budget.
+	TempInterpolate bool
+	ThreePhase      bool // Each EVSE charges from all three phases
+}
+
+type evseState struct {
+	name      string // Metric label and budget topic suffix
+	seen      bool
+	temp      Temperature
+	milliAmp  int64
+	volts     int64
+	connected bool
+	energyWh  float64 // Lifetime total
+	powerW    float64
+	minAmps   int32 // Configured on the EVSE, or the built in limit
+	maxAmps   int32
+	divert    DivertMode
+
+	pilotMismatchMilliAmp int64
+	havePilot             bool
+}
+
+// EVSEFleetStatus is the combined status of all EVSEs.
+type EVSEFleetStatus struct {
+	Temp      Temperature // Hottest EVSE
+	MilliAmp  int64       // Total
+	Volts     int64       // Highest plausible reading
+	Connected bool        // Any EVSE
+	EnergyWh  float64     // Total
+	MinAmps   int32       // Lowest EVSE min current, the least that charges anything
+	MaxAmps   int32       // Total of each EVSE's max current
+	AllSeen   bool        // Whether every EVSE has reported at least once
+
+	// DivertNormal if any EVSE ignores the budget, DivertEco if all that
+	// report a mode are in eco mode.
+	DivertMode DivertMode
+
+	// Total of EVSEStatus.PilotMismatch. HavePilot is false if no EVSE
+	// reports one.
+	PilotMismatchMilliAmp int64
+	HavePilot             bool
+}
+
+func NewEVSEFleet(names []string) *EVSEFleet {
+	f := &EVSEFleet{}
+	for _, name := range names {
+		f.evses = append(f.evses, evseState{name: name})
+	}
+	return f
+}
+
+// Update records the status of EVSE i and returns the combined status.
+func (f *EVSEFleet) Update(i int, status *EVSEStatus) EVSEFleetStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.evses[i] = evseState{
+		name:      f.evses[i].name,
+		seen:      true,
+		temp:      Temperature(status.Temp) * DeciCelcius,
+		milliAmp:  status.MilliAmp,
+		volts:     status.Voltage,
+		connected: status.Vehicle == 1,
+		energyWh:  status.TotalEnergy * 1000,
+		powerW:    status.powerW(f.phases()),
+		minAmps:   status.minAmpsOr(minAmps),
+		maxAmps:   status.maxAmpsOr(maxAmps),
+		divert:    status.DivertMode,
+	}
+	f.evses[i].pilotMismatchMilliAmp, f.evses[i].havePilot = status.PilotMismatch()
+
+	combined := EVSEFleetStatus{AllSeen: true}
+	first := true
+	for _, e := range f.evses {
+		if !e.seen {
+			combined.AllSeen = false
+			continue
+		}
+		if first || e.temp > combined.Temp {
+			first = false
+			combined.Temp = e.temp
+		}
+		if e.volts > combined.Volts && e.volts <= maxValidVolts {
+			combined.Volts = e.volts
+		}
+		combined.MilliAmp += e.milliAmp
+		combined.Connected = combined.Connected || e.connected
+		combined.EnergyWh += e.energyWh
+		if combined.MinAmps == 0 || e.minAmps < combined.MinAmps {
+			combined.MinAmps = e.minAmps
+		}
+		combined.MaxAmps += e.maxAmps
+		if e.havePilot {
+			combined.PilotMismatchMilliAmp += e.pilotMismatchMilliAmp
+			combined.HavePilot = true
+		}
+		if e.divert > DivertUnknown && (combined.DivertMode == DivertUnknown || e.divert < combined.DivertMode) {
+			combined.DivertMode = e.divert
+		}
+	}
+	return combined
+}
+
+func (f *EVSEFleet) phases() int32 {
+	if f.ThreePhase {
+		return 3
+	}
+	return 1
+}
+
+func (e *evseState) effectiveVolts() int32 {
+	if e.volts >= minValidVolts && e.volts <= maxValidVolts {
+		return int32(e.volts)
+	}
+	return volts
+}
+
+// wattsPerAmp converts this EVSE's charge current to power.
+func (e *evseState) wattsPerAmp(phases int32) int32 {
+	return e.effectiveVolts() * phases
+}
+
+// maxW is the most this EVSE may draw given its configured limit and temperature.
+func (e *evseState) maxW(interpolate bool, phases int32) int32 {
+	amps := MaxAmpsForTemp(e.temp, interpolate)
+	if e.maxAmps < amps {
+		amps = e.maxAmps
+	}
+	return e.wattsPerAmp(phases) * amps
+}
+
+// Split divides budgetW between connected EVSEs. Each EVSE is brought up to
+// its minimum charge rate before the next one is started, and whatever is left
+// is shared evenly (up to what each EVSE can take).
+func (f *EVSEFleet) Split(budgetW int32) []int32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	budgets := make([]int32, len(f.evses))
+	remaining := budgetW
+	var started []int
+	for i, e := range f.evses {
+		if !e.connected {
+			continue
+		}
+		if minW := e.wattsPerAmp(f.phases()) * e.minAmps; remaining >= minW {
+			budgets[i] = minW
+			remaining -= minW
+			started = append(started, i)
+		}
+	}
+
+	if len(started) == 0 {
+		// Not enough for any EVSE to charge. Pass the (possibly negative) budget
+		// on to the first connected EVSE, as if it was the only one.
+		for i, e := range f.evses {
+			if e.connected {
+				budgets[i] = budgetW
+				break
+			}
+		}
+		return budgets
+	}
+
+	for remaining > 0 {
+		var open []int
+		for _, i := range started {
+			if budgets[i] < f.evses[i].maxW(f.TempInterpolate, f.phases()) {
+				open = append(open, i)
+			}
+		}
+		if len(open) == 0 {
+			break
+		}
+
+		share := remaining / int32(len(open))
+		if share == 0 {
+			// Less than a watt each - not worth splitting.
+			share = remaining
+		}
+		for _, i := range open {
+			add := share
+			if room := f.evses[i].maxW(f.TempInterpolate, f.phases()) - budgets[i]; add > room {
+				add = room
+			}
+			if add > remaining {
+				add = remaining
+			}
+			budgets[i] += add
+			remaining -= add
+		}
+	}
+
+	return budgets
+}
+
+// PowerW returns the total power drawn by all EVSEs, and false until every
+// EVSE has reported.
+func (f *EVSEFleet) PowerW() (float64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var total float64
+	for _, e := range f.evses {
+		if !e.seen {
+			return 0, false
+		}
+		total += e.powerW
+	}
+	return total, true
+}
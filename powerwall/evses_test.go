@@ -0,0 +1,66 @@
+package powerwall
+
+import "testing"
+
+func TestEVSEFleetMinAmps(t *testing.T) {
+	f := NewEVSEFleet([]string{"a", "b"})
+	f.Update(0, &EVSEStatus{MinAmps: 10, MaxAmps: 32})
+	combined := f.Update(1, &EVSEStatus{MinAmps: 6})
+	if combined.MinAmps != 6 || combined.MaxAmps != 32+maxAmps {
+		t.Errorf("combined limits = %d-%d A, want 6-%d A", combined.MinAmps, combined.MaxAmps, 32+maxAmps)
+	}
+
+	combined = f.Update(1, &EVSEStatus{})
+	if combined.MinAmps != minAmps {
+		t.Errorf("combined min = %d A, want the built in %d A for an EVSE without limits", combined.MinAmps, minAmps)
+	}
+}
+
+func TestEVSEFleetSplit(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		threePhase bool
+		budgetW    int32
+		want       []int32
+	}{
+		{"single phase, both start", false, 10000, []int32{5000, 5000}},
+		{"single phase, one starts", false, 3000, []int32{3000, 0}},
+		{"three phase, one starts", true, 10000, []int32{10000, 0}},
+		{"three phase, both start", true, 12000, []int32{6000, 6000}},
+		{"three phase, capped", true, 60000, []int32{3 * 240 * 40, 3 * 240 * 40}},
+		{"below the minimum", true, 5000, []int32{5000, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := NewEVSEFleet([]string{"a", "b"})
+			f.ThreePhase = tc.threePhase
+			for i := range tc.want {
+				f.Update(i, &EVSEStatus{Vehicle: 1, Voltage: 240})
+			}
+
+			got := f.Split(tc.budgetW)
+			for i := range tc.want {
+				if got[i] != tc.want[i] {
+					t.Errorf("Split(%d) = %v, want %v", tc.budgetW, got, tc.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestEVSEFleetPowerW(t *testing.T) {
+	for _, tc := range []struct {
+		threePhase bool
+		want       float64
+	}{
+		{false, 240 * 16},
+		{true, 3 * 240 * 16},
+	} {
+		f := NewEVSEFleet([]string{"a"})
+		f.ThreePhase = tc.threePhase
+		f.Update(0, &EVSEStatus{MilliAmp: 16000, Voltage: 240})
+		if got, ok := f.PowerW(); !ok || got != tc.want {
+			t.Errorf("three phase %t: PowerW = %v, %t, want %v", tc.threePhase, got, ok, tc.want)
+		}
+	}
+}
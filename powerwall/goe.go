@@ -0,0 +1,72 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// GoEChargerClient reads status from a go-eCharger using its local HTTP API v2.
+// Only status is supported - the EV budget is still published over MQTT.
+type GoEChargerClient struct {
+	EVSEGauges
+	client  *http.Client
+	baseURL string // Like http://go-echarger.local
+}
+
+func NewGoEChargerClient(gauges EVSEGauges, client *http.Client, baseURL string) *GoEChargerClient {
+	return &GoEChargerClient{
+		EVSEGauges: gauges,
+		client:     client,
+		baseURL:    baseURL,
+	}
+}
+
+type goEStatus struct {
+	Car         int64     `json:"car"` // 1 idle, 2 charging, 3 waiting for car, 4 complete, 5 error
+	EnergyTotal float64   `json:"eto"` // Wh
+	Temps       []float64 `json:"tma"` // °C
+	MaxAmps     int64     `json:"ama"` // Configured absolute max current
+	// U L1, U L2, U L3, U N, I L1, I L2, I L3, P L1, P L2, P L3, P N, P Total, ...
+	Energy []float64 `json:"nrg"`
+}
+
+func (c *GoEChargerClient) GetStatus() (*EVSEStatus, error) {
+	url := c.baseURL + "/api/status?filter=car,eto,tma,nrg,ama"
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	var goeResp goEStatus
+	if err := json.NewDecoder(resp.Body).Decode(&goeResp); err != nil {
+		return nil, err
+	}
+
+	if len(goeResp.Energy) < 12 {
+		return nil, fmt.Errorf("go-eCharger returned %d nrg values, expected at least 12", len(goeResp.Energy))
+	}
+
+	status := &EVSEStatus{
+		MilliAmp:    int64(goeResp.Energy[4] * 1000),
+		Voltage:     int64(goeResp.Energy[0]),
+		TotalEnergy: goeResp.EnergyTotal / 1000,
+		Power:       goeResp.Energy[11],
+		MinAmps:     6, // Fixed for go-eCharger
+		MaxAmps:     goeResp.MaxAmps,
+	}
+	if len(goeResp.Temps) > 0 {
+		status.Temp = int64(goeResp.Temps[0] * 10)
+	}
+	if goeResp.Car >= 2 && goeResp.Car <= 4 {
+		status.Vehicle = 1
+	}
+
+	c.report(status)
+	return status, nil
+}
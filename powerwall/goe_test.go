@@ -0,0 +1,61 @@
+package powerwall
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGoEChargerStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"car":2,"eto":123456,"tma":[31.5,29],"ama":32,"nrg":[231,230,229,0,16.2,16,15.9,0,0,0,0,11100,0,0,0,0]}`))
+	}))
+	defer ts.Close()
+
+	gauges := newTestEVSEGauges()
+	gauges.Phases = 3
+	c := NewGoEChargerClient(gauges, ts.Client(), ts.URL)
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	want := EVSEStatus{
+		MilliAmp:    16200,
+		Voltage:     231,
+		Temp:        315,
+		TotalEnergy: 123.456,
+		Power:       11100,
+		Vehicle:     1,
+		MinAmps:     6,
+		MaxAmps:     32,
+	}
+	if *status != want {
+		t.Errorf("GetStatus = %+v, want %+v", *status, want)
+	}
+
+	// The reported power is the total of all three phases.
+	if pf := testutil.ToFloat64(c.PowerFactorGauge.WithLabelValues("ev")); math.Abs(pf-11100/(231*16.2*3)) > 1e-9 {
+		t.Errorf("power factor gauge = %v, want %v", pf, 11100/(231*16.2*3))
+	}
+}
+
+func TestGoEChargerStatusError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"busy"}`, http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c := NewGoEChargerClient(newTestEVSEGauges(), ts.Client(), ts.URL)
+	_, err := c.GetStatus()
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") {
+		t.Fatalf("GetStatus = %v, want an error with the HTTP status", err)
+	}
+}
@@ -0,0 +1,90 @@
+package powerwall
+
+import "log"
+
+// GridServicesAction changes Powerwall settings while a grid services (VPP)
+// event is active, and restores the previous settings once it ends. Only
+// accessed from the poll loop.
+type GridServicesAction struct {
+	client         *TeslaClient
+	reserve        *ReserveOverrides
+	reservePercent float64       // Backup reserve during events. Negative leaves it alone
+	mode           OperationMode // Operation mode during events. OperationUnknown leaves it alone
+	dryRun         bool
+
+	active    bool
+	modeSet   bool          // The event mode has been applied
+	savedMode OperationMode // Mode to restore once the event ends
+}
+
+const gridServicesOwner = "Grid services event"
+
+// NewGridServicesAction returns an action that applies reservePercent (through
+// reserve) and mode during events. A negative reservePercent or
+// OperationUnknown leaves that setting alone.
+func NewGridServicesAction(client *TeslaClient, reserve *ReserveOverrides, reservePercent float64, mode OperationMode, dryRun bool) *GridServicesAction {
+	return &GridServicesAction{
+		client:         client,
+		reserve:        reserve,
+		reservePercent: reservePercent,
+		mode:           mode,
+		dryRun:         dryRun,
+	}
+}
+
+func (a *GridServicesAction) enabled() bool {
+	return a.reservePercent >= 0 || a.mode != OperationUnknown
+}
+
+// Update applies or reverts the event settings when active changes.
+func (a *GridServicesAction) Update(active bool) error {
+	if !a.enabled() || active == a.active {
+		return nil
+	}
+
+	if active {
+		// After a failure part way through, only what didn't happen is retried.
+		// Reading the mode again would save the event mode to restore.
+		if a.mode != OperationUnknown && !a.modeSet {
+			op, err := a.client.GetOperation()
+			if err != nil {
+				return err
+			}
+			log.Printf("Grid services event started, switching Powerwall from %s to %s", op.Mode, a.mode)
+			if err := a.setMode(a.mode); err != nil {
+				return err
+			}
+			a.savedMode, a.modeSet = op.Mode, true
+		}
+		if a.reservePercent >= 0 {
+			if err := a.reserve.Push(gridServicesOwner, a.reservePercent); err != nil {
+				return err
+			}
+		}
+		a.active = true
+		return nil
+	}
+
+	if a.modeSet {
+		if a.savedMode != OperationUnknown {
+			log.Printf("Grid services event ended, restoring Powerwall to %s", a.savedMode)
+			if err := a.setMode(a.savedMode); err != nil {
+				return err
+			}
+		}
+		a.savedMode, a.modeSet = OperationUnknown, false
+	}
+	if err := a.reserve.Pop(gridServicesOwner); err != nil {
+		return err
+	}
+	a.active = false
+	return nil
+}
+
+func (a *GridServicesAction) setMode(mode OperationMode) error {
+	if a.dryRun {
+		log.Printf("[DRY RUN] Setting Powerwall to %s", mode)
+		return nil
+	}
+	return a.client.SetOperationMode(mode)
+}
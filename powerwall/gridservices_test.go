@@ -0,0 +1,78 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// gatewayOperation returns the operation settings last posted to g.
+func gatewayOperation(t *testing.T, g *fakeGateway) (mode string, reservePercent float64) {
+	t.Helper()
+	var op struct {
+		Mode                 string  `json:"real_mode"`
+		BackupReservePercent float64 `json:"backup_reserve_percent"`
+	}
+	if err := json.Unmarshal(g.postedBody("/api/operation"), &op); err != nil {
+		t.Fatalf("decoding posted operation: %v", err)
+	}
+	return op.Mode, op.BackupReservePercent
+}
+
+// If the mode is changed but the reserve isn't, the retry must still restore
+// the mode from before the event.
+func TestGridServicesActionRetry(t *testing.T) {
+	g, c := newReserveTest(t)
+	failed := false
+	g.failPost = func(path string, body []byte) bool {
+		if path != "/api/operation" || failed {
+			return false
+		}
+		var op struct {
+			BackupReservePercent float64 `json:"backup_reserve_percent"`
+		}
+		failed = json.Unmarshal(body, &op) == nil && op.BackupReservePercent == 100
+		return failed
+	}
+	a := NewGridServicesAction(c, NewReserveOverrides(c, false), 100, OperationBackup, false)
+
+	if err := a.Update(true); err == nil {
+		t.Fatalf("Update(true) succeeded with the reserve change failing")
+	}
+	if mode, reserve := gatewayOperation(t, g); mode != "backup" || reserve != 20 {
+		t.Fatalf("after the failure: %s, %v%%, want backup, 20%%", mode, reserve)
+	}
+
+	if err := a.Update(true); err != nil {
+		t.Fatalf("Update(true) retry: %v", err)
+	}
+	if mode, reserve := gatewayOperation(t, g); mode != "backup" || reserve != 100 {
+		t.Errorf("during the event: %s, %v%%, want backup, 100%%", mode, reserve)
+	}
+
+	if err := a.Update(false); err != nil {
+		t.Fatalf("Update(false): %v", err)
+	}
+	if mode, reserve := gatewayOperation(t, g); mode != "self_consumption" || reserve != 20 {
+		t.Errorf("after the event: %s, %v%%, want self_consumption, 20%%", mode, reserve)
+	}
+}
+
+func TestGridServicesActionModeOnly(t *testing.T) {
+	g, c := newReserveTest(t)
+	a := NewGridServicesAction(c, NewReserveOverrides(c, false), -1, OperationBackup, false)
+
+	for i := 0; i < 2; i++ {
+		if err := a.Update(true); err != nil {
+			t.Fatalf("Update(true): %v", err)
+		}
+		if mode, reserve := gatewayOperation(t, g); mode != "backup" || reserve != 20 {
+			t.Errorf("event %d: %s, %v%%, want backup, 20%%", i, mode, reserve)
+		}
+		if err := a.Update(false); err != nil {
+			t.Fatalf("Update(false): %v", err)
+		}
+		if mode, reserve := gatewayOperation(t, g); mode != "self_consumption" || reserve != 20 {
+			t.Errorf("after event %d: %s, %v%%, want self_consumption, 20%%", i, mode, reserve)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package powerwall
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteHAPackage writes a Home Assistant package (YAML) defining the same
+// entities as MQTT discovery, for setups that have discovery disabled.
+func (r *MQTTReporter) WriteHAPackage(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Home Assistant package for %s. Save it in the packages directory of the\n", r.topic)
+	fmt.Fprintf(bw, "# Home Assistant configuration.\n")
+	fmt.Fprintf(bw, "mqtt:\n")
+
+	for _, component := range []string{"sensor", "binary_sensor", "switch", "device_tracker"} {
+		fmt.Fprintf(bw, "  %s:\n", component)
+		for _, e := range haEntities {
+			if e.component != component || r.Disabled[e.id] {
+				continue
+			}
+
+			msg := r.discoveryMessage(e)
+			// Double quoted YAML strings use the same escapes as Go.
+			field := func(key, value string) {
+				if value != "" {
+					fmt.Fprintf(bw, "      %s: %s\n", key, strconv.Quote(value))
+				}
+			}
+			fmt.Fprintf(bw, "    - name: %s\n", strconv.Quote(msg.Name))
+			field("unique_id", msg.UniqueID)
+			field("state_topic", msg.StateTopic)
+			field("command_topic", msg.CommandTopic)
+			field("availability_topic", msg.AvailabilityTopic)
+			field("json_attributes_topic", msg.AttributesTopic)
+			field("unit_of_measurement", msg.UnitOfMeasurement)
+			field("device_class", msg.DeviceClass)
+			field("state_class", msg.StateClass)
+			field("payload_on", msg.PayloadOn)
+			field("payload_off", msg.PayloadOff)
+			field("payload_home", msg.PayloadHome)
+			field("payload_not_home", msg.PayloadNotHome)
+			field("source_type", msg.SourceType)
+			field("icon", msg.Icon)
+			if len(msg.Options) > 0 {
+				fmt.Fprintf(bw, "      options:\n")
+				for _, o := range msg.Options {
+					fmt.Fprintf(bw, "        - %s\n", strconv.Quote(o))
+				}
+			}
+			if msg.ExpireAfter > 0 {
+				fmt.Fprintf(bw, "      expire_after: %d\n", msg.ExpireAfter)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,310 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EVSEClient reads status from an EV charger. Implementations normalize their
+// device's status into EVSEStatus (which follows OpenEVSE's units).
+type EVSEClient interface {
+	GetStatus() (*EVSEStatus, error)
+}
+
+type EVSEGauges struct {
+	Label               string // meter label, like "ev"
+	Phases              int    // Phases the EVSE charges from, for the power factor
+	CurrentGauge        *prometheus.GaugeVec
+	EnergyImportedGauge *prometheus.GaugeVec
+	PowerGauge          *prometheus.GaugeVec
+	TempGauge           *prometheus.GaugeVec
+	ConnectedGauge      *prometheus.GaugeVec
+	VoltageGauge        *prometheus.GaugeVec
+	PowerFactorGauge    *prometheus.GaugeVec
+	EstimatedGauge      *prometheus.GaugeVec
+	CurrentLimitGauge   *prometheus.GaugeVec
+	DivertModeGauge     *prometheus.GaugeVec
+	PilotGauge          *prometheus.GaugeVec
+	PilotMismatchGauge  *prometheus.GaugeVec
+}
+
+func (g *EVSEGauges) report(status *EVSEStatus) {
+	g.CurrentGauge.WithLabelValues(g.Label).Set(float64(status.MilliAmp) / 1000)
+	g.EnergyImportedGauge.WithLabelValues(g.Label).Set(status.TotalEnergy * 1000)
+	g.PowerGauge.WithLabelValues(g.Label).Set(status.Power)
+	g.TempGauge.WithLabelValues(g.Label).Set(float64(status.Temp) / 10)
+	g.ConnectedGauge.WithLabelValues(g.Label).Set(float64(status.Vehicle))
+	g.VoltageGauge.WithLabelValues(g.Label).Set(float64(status.Voltage))
+
+	if status.DivertMode != DivertUnknown {
+		g.DivertModeGauge.WithLabelValues(g.Label).Set(float64(status.DivertMode))
+	}
+
+	if mismatchMilliAmp, ok := status.PilotMismatch(); ok {
+		g.PilotGauge.WithLabelValues(g.Label).Set(float64(status.Pilot))
+		g.PilotMismatchGauge.WithLabelValues(g.Label).Set(float64(mismatchMilliAmp) / 1000)
+	} else {
+		g.PilotGauge.DeleteLabelValues(g.Label)
+		g.PilotMismatchGauge.DeleteLabelValues(g.Label)
+	}
+
+	g.CurrentLimitGauge.WithLabelValues(g.Label + "-min").Set(float64(status.minAmpsOr(minAmps)))
+	g.CurrentLimitGauge.WithLabelValues(g.Label + "-max").Set(float64(status.maxAmpsOr(maxAmps)))
+
+	if pf, estimated, ok := status.PowerFactor(g.Phases); ok {
+		g.PowerFactorGauge.WithLabelValues(g.Label).Set(pf)
+		if estimated {
+			g.EstimatedGauge.WithLabelValues(g.Label + "-power-factor").Set(1)
+		} else {
+			g.EstimatedGauge.WithLabelValues(g.Label + "-power-factor").Set(0)
+		}
+	} else {
+		g.PowerFactorGauge.DeleteLabelValues(g.Label)
+		g.EstimatedGauge.DeleteLabelValues(g.Label + "-power-factor")
+	}
+}
+
+// PilotMismatch returns how much less the car draws than the pilot offers.
+// A lasting mismatch means the car is limiting its own charge rate. ok is
+// false if no car is connected or the pilot isn't reported.
+func (s *EVSEStatus) PilotMismatch() (milliAmp int64, ok bool) {
+	if s.Vehicle != 1 || s.Pilot <= 0 {
+		return 0, false
+	}
+	return s.Pilot*1000 - s.MilliAmp, true
+}
+
+// PowerFactor returns real power / apparent power (V×I per phase, over
+// phases, like powerW). When the charger doesn't report real power, the power
+// factor is assumed to be 1 and estimated is set. ok is false if nothing is
+// flowing.
+func (s *EVSEStatus) PowerFactor(phases int) (pf float64, estimated bool, ok bool) {
+	apparentVA := float64(s.Voltage) * float64(s.MilliAmp) * float64(phases) / 1000
+	if apparentVA <= 0 {
+		return 0, false, false
+	}
+
+	if s.Power <= 0 {
+		return 1, true, true
+	}
+
+	pf = s.Power / apparentVA
+	if pf > 1 {
+		// Rounding in the reported values can push this slightly over 1.
+		pf = 1
+	}
+	return pf, false, true
+}
+
+// powerW returns the real power drawn, or V×I (per phase) if the charger
+// doesn't report it.
+func (s *EVSEStatus) powerW(phases int32) float64 {
+	if s.Power > 0 {
+		return s.Power
+	}
+	return float64(s.Voltage) * float64(s.MilliAmp) * float64(phases) / 1000
+}
+
+// EVSEBaseURLs returns the base URL of every EVSE. urls is a comma separated
+// list of full base URLs, and addrs (the legacy form) a list of addresses
+// reached over plain HTTP. Only one of them may be set.
+func EVSEBaseURLs(addrs, urls string) ([]string, error) {
+	if addrs != "" && urls != "" {
+		return nil, fmt.Errorf("only one of -openevse and -openevse-url may be set")
+	}
+
+	var baseURLs []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			baseURLs = append(baseURLs, "http://"+addr)
+		}
+	}
+
+	for _, rawURL := range strings.Split(urls, ",") {
+		if rawURL = strings.TrimSpace(rawURL); rawURL == "" {
+			continue
+		}
+
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q: expected http(s)://host[/path]", rawURL)
+		}
+		baseURLs = append(baseURLs, strings.TrimSuffix(u.String(), "/"))
+	}
+
+	return baseURLs, nil
+}
+
+// DivertMode is OpenEVSE's charge mode. In normal (fast) mode it charges at
+// full current and ignores the solar/grid feed the budget is published to.
+type DivertMode int64
+
+const (
+	DivertUnknown DivertMode = 0 // Not reported (older firmware, other EVSEs)
+	DivertNormal  DivertMode = 1
+	DivertEco     DivertMode = 2
+)
+
+func (m DivertMode) String() string {
+	switch m {
+	case DivertNormal:
+		return "normal"
+	case DivertEco:
+		return "eco"
+	default:
+		return "unknown"
+	}
+}
+
+type OpenEVSEClient struct {
+	EVSEGauges
+	client  *http.Client
+	baseURL string // Like http://openevse.local or https://host/openevse
+
+	// Current limits from /config, which rarely change. Fetched again after
+	// an error or once the EVSE is back after being unreachable. Only
+	// accessed from the EVSE's poll loop.
+	limits        *currentLimits
+	limitsFailing bool // The last /config fetch failed, and was logged
+}
+
+// currentLimits are the current limits configured on the EVSE, in A. 0 if not
+// reported.
+type currentLimits struct {
+	minAmps int64
+	maxAmps int64
+}
+
+func NewOpenEVSEClient(gauges EVSEGauges, client *http.Client, baseURL string) *OpenEVSEClient {
+	return &OpenEVSEClient{
+		EVSEGauges: gauges,
+		client:     client,
+		baseURL:    baseURL,
+	}
+}
+
+type EVSEStatus struct {
+	// All fields use OpenEVSE units: mA, deci-Celsius, V, kWh, W.
+	// Vehicle is 1 when a vehicle is connected.
+	MilliAmp      int64   `json:"amp"`
+	Temp          int64   `json:"temp"`
+	Pilot         int64   `json:"pilot"` // Current offered to the car, in A. 0 if not reported
+	Voltage       int64   `json:"voltage"`
+	TotalEnergy   float64 `json:"total_energy"`
+	Vehicle       int64   `json:"vehicle"`
+	Power         float64 `json:"power"`
+	MQTTConnected int64   `json:"mqtt_connected"`
+
+	// OpenEVSE's own solar divert mode. The published budget only takes
+	// effect in eco mode.
+	DivertMode DivertMode `json:"divertmode"`
+
+	// Current limits configured on the EVSE, in A. 0 if not reported.
+	MinAmps int64 `json:"-"`
+	MaxAmps int64 `json:"-"`
+}
+
+// minAmpsOr returns the EVSE's minimum current, or def if it isn't reported.
+func (s *EVSEStatus) minAmpsOr(def int32) int32 {
+	if s.MinAmps > 0 {
+		return int32(s.MinAmps)
+	}
+	return def
+}
+
+// maxAmpsOr returns the EVSE's maximum current, or def if it isn't reported.
+func (s *EVSEStatus) maxAmpsOr(def int32) int32 {
+	if s.MaxAmps > 0 {
+		return int32(s.MaxAmps)
+	}
+	return def
+}
+
+func (c *OpenEVSEClient) GetStatus() (*EVSEStatus, error) {
+	resp, err := c.client.Get(c.baseURL + "/status")
+	if err != nil {
+		// The limits may have been changed while it was unreachable.
+		c.limits = nil
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.limits = nil
+		return nil, fmt.Errorf("unexpected status fetching /status: %s", resp.Status)
+	}
+
+	var evStatusResp EVSEStatus
+
+	if err := json.NewDecoder(resp.Body).Decode(&evStatusResp); err != nil {
+		return nil, err
+	}
+
+	if c.limits == nil {
+		limits, err := c.getCurrentLimits()
+		switch {
+		case err == nil:
+			c.limits = limits
+			c.limitsFailing = false
+		case !c.limitsFailing:
+			// Retried on the next poll. Until then, the built in limits apply.
+			log.Printf("Error getting current limits from OpenEVSE: %v", err)
+			c.limitsFailing = true
+		}
+	}
+	if c.limits != nil {
+		evStatusResp.MinAmps = c.limits.minAmps
+		evStatusResp.MaxAmps = c.limits.maxAmps
+	}
+
+	c.report(&evStatusResp)
+	c.ConnectedGauge.WithLabelValues("mqtt").Set(float64(evStatusResp.MQTTConnected))
+
+	return &evStatusResp, nil
+}
+
+// getCurrentLimits returns the min and max current configured on the EVSE.
+// The user configured (soft) max wins over the hardware max. Older firmware
+// without /config has no limits, so the built in ones apply.
+func (c *OpenEVSEClient) getCurrentLimits() (*currentLimits, error) {
+	resp, err := c.client.Get(c.baseURL + "/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		log.Printf("OpenEVSE at %s doesn't report its current limits, using the built in limits", c.baseURL)
+		return &currentLimits{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching /config: %s", resp.Status)
+	}
+
+	var config struct {
+		MinCurrentHard int64 `json:"min_current_hard"`
+		MaxCurrentHard int64 `json:"max_current_hard"`
+		MaxCurrentSoft int64 `json:"max_current_soft"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, err
+	}
+
+	limits := &currentLimits{
+		minAmps: config.MinCurrentHard,
+		maxAmps: config.MaxCurrentHard,
+	}
+	if config.MaxCurrentSoft > 0 && (limits.maxAmps == 0 || config.MaxCurrentSoft < limits.maxAmps) {
+		limits.maxAmps = config.MaxCurrentSoft
+	}
+	return limits, nil
+}
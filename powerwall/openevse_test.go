@@ -0,0 +1,190 @@
+package powerwall
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeOpenEVSE serves /status and /config like OpenEVSE's HTTP API.
+type fakeOpenEVSE struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	statusCode    int // For /status
+	configCode    int // For /config
+	config        string
+	configFetches int
+}
+
+const testOpenEVSEStatus = `{"amp":16000,"temp":305,"voltage":240,"vehicle":1,"power":3840,"divertmode":2}`
+
+func newFakeOpenEVSE(t *testing.T) *fakeOpenEVSE {
+	f := &fakeOpenEVSE{
+		statusCode: http.StatusOK,
+		configCode: http.StatusOK,
+		config:     `{"min_current_hard":6,"max_current_hard":48,"max_current_soft":32}`,
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		switch r.URL.Path {
+		case "/status":
+			w.WriteHeader(f.statusCode)
+			_, _ = w.Write([]byte(testOpenEVSEStatus))
+		case "/config":
+			f.configFetches++
+			w.WriteHeader(f.configCode)
+			_, _ = w.Write([]byte(f.config))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOpenEVSE) set(statusCode, configCode int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.statusCode, f.configCode = statusCode, configCode
+}
+
+func (f *fakeOpenEVSE) fetches() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.configFetches
+}
+
+func newTestEVSEGauges() EVSEGauges {
+	gauge := func(name string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, []string{"meter"})
+	}
+	return EVSEGauges{
+		Label:               "ev",
+		Phases:              1,
+		CurrentGauge:        gauge("current"),
+		EnergyImportedGauge: gauge("energy_imported"),
+		PowerGauge:          gauge("power"),
+		TempGauge:           gauge("temp"),
+		ConnectedGauge:      gauge("connected"),
+		VoltageGauge:        gauge("voltage"),
+		PowerFactorGauge:    gauge("power_factor"),
+		EstimatedGauge:      gauge("estimated"),
+		CurrentLimitGauge:   gauge("current_limit"),
+		DivertModeGauge:     gauge("divert_mode"),
+		PilotGauge:          gauge("pilot"),
+		PilotMismatchGauge:  gauge("pilot_mismatch"),
+	}
+}
+
+// poll gets the status from c, and returns the limits it reported.
+func poll(t *testing.T, c *OpenEVSEClient) (minAmps, maxAmps int64) {
+	t.Helper()
+	status, err := c.GetStatus()
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	if status.MilliAmp != 16000 || status.Vehicle != 1 || status.DivertMode != DivertEco {
+		t.Errorf("GetStatus = %+v", status)
+	}
+	return status.MinAmps, status.MaxAmps
+}
+
+func TestOpenEVSECurrentLimits(t *testing.T) {
+	f := newFakeOpenEVSE(t)
+	c := NewOpenEVSEClient(newTestEVSEGauges(), f.Client(), f.URL)
+
+	// The soft max is below the hardware max, so it wins.
+	for i := 0; i < 3; i++ {
+		if minA, maxA := poll(t, c); minA != 6 || maxA != 32 {
+			t.Errorf("poll %d: limits = %d-%d A, want 6-32 A", i, minA, maxA)
+		}
+	}
+	if got := f.fetches(); got != 1 {
+		t.Errorf("/config fetched %d times, want once", got)
+	}
+	if got := testutil.ToFloat64(c.CurrentLimitGauge.WithLabelValues("ev-max")); got != 32 {
+		t.Errorf("max current limit gauge = %v, want 32", got)
+	}
+
+	// Unreachable: the limits are fetched again once it's back.
+	f.set(http.StatusServiceUnavailable, http.StatusOK)
+	if _, err := c.GetStatus(); err == nil {
+		t.Fatalf("GetStatus succeeded with /status failing")
+	}
+	f.set(http.StatusOK, http.StatusOK)
+	poll(t, c)
+	if got := f.fetches(); got != 2 {
+		t.Errorf("/config fetched %d times, want again after /status failed", got)
+	}
+}
+
+func TestOpenEVSECurrentLimitsFailing(t *testing.T) {
+	f := newFakeOpenEVSE(t)
+	f.set(http.StatusOK, http.StatusInternalServerError)
+	c := NewOpenEVSEClient(newTestEVSEGauges(), f.Client(), f.URL)
+
+	// The status is still reported, with the built in limits.
+	for i := 0; i < 2; i++ {
+		if minA, maxA := poll(t, c); minA != 0 || maxA != 0 {
+			t.Errorf("poll %d: limits = %d-%d A, want none", i, minA, maxA)
+		}
+	}
+	if got := testutil.ToFloat64(c.CurrentLimitGauge.WithLabelValues("ev-min")); got != minAmps {
+		t.Errorf("min current limit gauge = %v, want the built in %d", got, minAmps)
+	}
+	if got := f.fetches(); got != 2 {
+		t.Errorf("/config fetched %d times, want on every poll while failing", got)
+	}
+
+	f.set(http.StatusOK, http.StatusOK)
+	if minA, maxA := poll(t, c); minA != 6 || maxA != 32 {
+		t.Errorf("after recovering: limits = %d-%d A, want 6-32 A", minA, maxA)
+	}
+}
+
+func TestOpenEVSEWithoutConfig(t *testing.T) {
+	f := newFakeOpenEVSE(t)
+	f.set(http.StatusOK, http.StatusNotFound)
+	c := NewOpenEVSEClient(newTestEVSEGauges(), f.Client(), f.URL)
+
+	// Older firmware: the built in limits apply, and there's no point asking again.
+	for i := 0; i < 2; i++ {
+		if minA, maxA := poll(t, c); minA != 0 || maxA != 0 {
+			t.Errorf("poll %d: limits = %d-%d A, want none", i, minA, maxA)
+		}
+	}
+	if got := f.fetches(); got != 1 {
+		t.Errorf("/config fetched %d times, want once", got)
+	}
+}
+
+func TestEVSEPowerFactor(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		status        EVSEStatus
+		phases        int
+		wantPF        float64
+		wantEstimated bool
+		wantOK        bool
+	}{
+		{"single phase", EVSEStatus{Voltage: 240, MilliAmp: 16000, Power: 3648}, 1, 0.95, false, true},
+		{"rounded over 1", EVSEStatus{Voltage: 240, MilliAmp: 16000, Power: 3850}, 1, 1, false, true},
+		{"no real power", EVSEStatus{Voltage: 240, MilliAmp: 16000}, 1, 1, true, true},
+		{"idle", EVSEStatus{Voltage: 240, Power: 0}, 1, 0, false, false},
+		// Real power covers all three phases, the current one of them.
+		{"three phase", EVSEStatus{Voltage: 230, MilliAmp: 16000, Power: 10488}, 3, 0.95, false, true},
+		{"three phase without real power", EVSEStatus{Voltage: 230, MilliAmp: 16000}, 3, 1, true, true},
+	} {
+		pf, estimated, ok := tc.status.PowerFactor(tc.phases)
+		if math.Abs(pf-tc.wantPF) > 1e-9 || estimated != tc.wantEstimated || ok != tc.wantOK {
+			t.Errorf("%s: PowerFactor = %v, %t, %t, want %v, %t, %t", tc.name, pf, estimated, ok, tc.wantPF, tc.wantEstimated, tc.wantOK)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package powerwall
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket. Callers block in wait until a token is
+// available. A nil *RateLimiter never throttles.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait before using it.
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) wait(what string) {
+	if l == nil {
+		return
+	}
+
+	if d := l.reserve(time.Now()); d > 0 {
+		log.Printf("Throttling %s for %s (rate limit %.1f/s)", what, d.Round(time.Millisecond), l.rate)
+		time.Sleep(d)
+	}
+}
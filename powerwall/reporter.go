@@ -0,0 +1,675 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mqttMessage struct {
+	topic    string
+	payload  string
+	retained bool
+
+	// Changed values aren't published more often than this. The next report
+	// after the interval publishes the latest value.
+	minInterval time.Duration
+
+	// Not a message: tells PublishLoop to forget what it has published, so
+	// every value goes out again on its next report.
+	reset bool
+}
+
+// MQTTReporter publishes sensor values to MQTT and registers them with Home
+// Assistant via MQTT discovery. Report* methods never block - messages are
+// queued and published from PublishLoop.
+type MQTTReporter struct {
+	client          mqtt.Client
+	topic           string
+	discoveryPrefix string
+	queue           chan mqttMessage
+	now             func() time.Time // time.Now, except in tests
+
+	// Optional. NamePrefix is prepended to every entity's friendly name, and
+	// Icons overrides the Home Assistant icon (like mdi:ev-station) by entity id.
+	NamePrefix string
+	Icons      map[string]string
+
+	// Optional. Shown as the device's firmware in Home Assistant, like the
+	// gateway's version.
+	SWVersion string
+
+	// Optional. Track how close queue is to dropping messages.
+	QueueDepthGauge prometheus.Gauge
+	DroppedCounter  prometheus.Counter
+
+	lock          sync.Mutex
+	subscriptions map[string]mqtt.MessageHandler
+
+	// Optional. If set, values are published at least this often even if
+	// unchanged, and Home Assistant expires them if they stop coming.
+	HeartbeatInterval time.Duration
+
+	// Optional. Minimum time between publishes of a changed value, by entity
+	// id. Meant for noisy values reported on every poll (like solar_power).
+	MinIntervals map[string]time.Duration
+
+	// Optional. If set, every value is accompanied by its read time, as the
+	// last_updated attribute of the entity. Lets Home Assistant show the age
+	// of values that don't change often.
+	LastUpdated bool
+
+	// Optional. Entities by id that aren't registered with Home Assistant and
+	// whose values aren't published.
+	Disabled map[string]bool
+
+	// Decimals published for temperatures (°C) and powers (W). Defaults to 1
+	// and 0; more only adds noise to the Home Assistant recorder.
+	TempPrecision  int
+	PowerPrecision int
+
+	// Only accessed from PublishLoop
+	lastSeenValues  map[string]string
+	lastPublishedAt map[string]time.Time
+}
+
+func NewMQTTReporter(client mqtt.Client, topic string, discoveryPrefix string) *MQTTReporter {
+	return &MQTTReporter{
+		client:          client,
+		topic:           topic,
+		discoveryPrefix: discoveryPrefix,
+		queue:           make(chan mqttMessage, 100),
+		now:             time.Now,
+		subscriptions:   make(map[string]mqtt.MessageHandler),
+		lastSeenValues:  make(map[string]string),
+		lastPublishedAt: make(map[string]time.Time),
+		TempPrecision:   1,
+	}
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+type haDiscoveryMessage struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	AttributesTopic   string   `json:"json_attributes_topic,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	PayloadHome       string   `json:"payload_home,omitempty"`
+	PayloadNotHome    string   `json:"payload_not_home,omitempty"`
+	SourceType        string   `json:"source_type,omitempty"`
+	Options           []string `json:"options,omitempty"`      // For device class "enum"
+	ExpireAfter       int      `json:"expire_after,omitempty"` // Seconds
+	Device            haDevice `json:"device"`
+}
+
+func (r *MQTTReporter) stateTopic(id string) string {
+	return fmt.Sprintf("%s/%s", r.topic, id)
+}
+
+func (r *MQTTReporter) attributesTopic(id string) string {
+	return fmt.Sprintf("%s/%s/attributes", r.topic, id)
+}
+
+// CommandTopic is where commands (like POLL) for this instance are received.
+func (r *MQTTReporter) CommandTopic(command string) string {
+	return fmt.Sprintf("cmnd/%s/%s", r.topic, command)
+}
+
+// AvailabilityTopic is where "online"/"offline" is published for Home
+// Assistant. "offline" is set as the last will on the MQTT connection.
+func AvailabilityTopic(topic string) string {
+	return fmt.Sprintf("%s/availability", topic)
+}
+
+// expireAfter gives Home Assistant some slack (a few missed heartbeats)
+// before it marks a value as unavailable.
+func (r *MQTTReporter) expireAfter() int {
+	return int((3 * r.HeartbeatInterval).Seconds())
+}
+
+func (r *MQTTReporter) device() haDevice {
+	return haDevice{
+		Identifiers:  []string{r.topic},
+		Name:         r.topic,
+		Manufacturer: "powerwall2mqtt",
+		Model:        "Powerwall + OpenEVSE controller",
+		SWVersion:    r.SWVersion,
+	}
+}
+
+func (r *MQTTReporter) discoveryTopic(component, id string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", r.discoveryPrefix, component, r.topic, id)
+}
+
+func (r *MQTTReporter) publishDiscoveryMessage(component string, id string, msg haDiscoveryMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	token := r.client.Publish(r.discoveryTopic(component, id), 1, true, b)
+	_ = token.Wait()
+	return token.Error()
+}
+
+// removeDiscoveryMessage clears the retained config of an entity, which makes
+// Home Assistant drop it if it was registered before being disabled.
+func (r *MQTTReporter) removeDiscoveryMessage(component string, id string) error {
+	token := r.client.Publish(r.discoveryTopic(component, id), 1, true, "")
+	_ = token.Wait()
+	return token.Error()
+}
+
+// discoveryMessage describes e to Home Assistant. It is also the source of
+// the package YAML served for setups without MQTT discovery.
+func (r *MQTTReporter) discoveryMessage(e haEntity) haDiscoveryMessage {
+	msg := haDiscoveryMessage{
+		Name:              r.NamePrefix + e.name,
+		UniqueID:          fmt.Sprintf("%s_%s", r.topic, e.id),
+		StateTopic:        r.stateTopic(e.id),
+		AvailabilityTopic: AvailabilityTopic(r.topic),
+		DeviceClass:       e.deviceClass,
+		Icon:              r.Icons[e.id],
+		ExpireAfter:       r.expireAfter(),
+		Device:            r.device(),
+	}
+	if r.LastUpdated {
+		msg.AttributesTopic = r.attributesTopic(e.id)
+	}
+	switch e.component {
+	case "binary_sensor":
+		msg.PayloadOn = "ON"
+		msg.PayloadOff = "OFF"
+	case "switch":
+		// The state is only published on change, so it must not expire.
+		msg.PayloadOn = "ON"
+		msg.PayloadOff = "OFF"
+		msg.CommandTopic = r.CommandTopic(strings.ToUpper(e.id))
+		msg.ExpireAfter = 0
+	case "device_tracker":
+		// Also only published on change.
+		msg.PayloadHome = "home"
+		msg.PayloadNotHome = "not_home"
+		msg.SourceType = "router"
+		msg.ExpireAfter = 0
+	default:
+		msg.UnitOfMeasurement = e.unit
+		msg.StateClass = e.stateClass
+		msg.Options = haEnumOptions[e.id]
+	}
+	return msg
+}
+
+type haEntity struct {
+	component   string // "sensor", "binary_sensor", "switch" or "device_tracker"
+	id          string
+	name        string
+	unit        string
+	deviceClass string
+	// "measurement" for instantaneous values, "total_increasing" for counters
+	// (including ones that reset daily), and "" for text sensors, which Home
+	// Assistant rejects a state class on.
+	stateClass string
+}
+
+// haEntities lists every entity registered with Home Assistant. Discovery is
+// published from this list both on the initial connect and on every reconnect.
+var haEntities = []haEntity{
+	{"sensor", "solar_power", "Solar Power", "W", "power", "measurement"},
+	{"sensor", "load_power", "Load Power", "W", "power", "measurement"},
+	{"sensor", "grid_power", "Grid Power", "W", "power", "measurement"},
+	{"sensor", "powerwall_battery_level", "Powerwall Battery Level", "%", "battery", "measurement"},
+	{"sensor", "battery_export", "Powerwall Battery Export", "W", "power", "measurement"},
+	{"sensor", "battery_state", "Powerwall Battery State", "", "", ""},
+	{"sensor", "operation_mode", "Powerwall Operation Mode", "", "enum", ""},
+	{"sensor", "solar_energy_today", "Solar Energy Today", "Wh", "energy", "total_increasing"},
+	{"sensor", "ev_energy_today", "EV Energy Today", "Wh", "energy", "total_increasing"},
+	{"sensor", "evse_temperature", "EVSE Temperature", "°C", "temperature", "measurement"},
+	{"sensor", "evse_current", "EVSE Current", "A", "current", "measurement"},
+	{"sensor", "evse_current_gap", "EVSE Current Gap", "A", "current", "measurement"},
+	{"sensor", "evse_pilot_mismatch", "EVSE Pilot Mismatch", "A", "current", "measurement"},
+	{"sensor", "evse_temp_max_amps", "EVSE Temperature Current Limit", "A", "current", "measurement"},
+	{"sensor", "evse_max_current", "EVSE Max Current", "A", "current", "measurement"},
+	{"sensor", "evse_divert_mode", "EVSE Charge Mode", "", "", ""},
+	{"sensor", "evse_power_factor", "EVSE Power Factor", "", "power_factor", "measurement"},
+	{"binary_sensor", "evse_power_factor_estimated", "EVSE Power Factor Estimated", "", "", ""},
+	{"sensor", "ev_budget", "EV Power Budget", "W", "power", "measurement"},
+	{"sensor", "minutes_until_off_peak", "Minutes Until Off-Peak", "min", "duration", "measurement"},
+	{"sensor", "boost_remaining", "EV Boost Remaining", "min", "duration", "measurement"},
+	{"sensor", "budget_override", "EV Budget Override", "", "", ""},
+	{"sensor", "budget_reason", "EV Budget Reason", "", "", ""},
+	{"sensor", "grid_services_active_today", "Grid Services Active Today", "s", "duration", "total_increasing"},
+	{"sensor", "grid_services_events_today", "Grid Services Events Today", "events", "", "total_increasing"},
+	{"binary_sensor", "ev_connected", "EV Connected", "", "plug", ""},
+	{"binary_sensor", "off_peak", "Off-Peak", "", "", ""},
+	{"binary_sensor", "data_stale", "Powerwall Data Stale", "", "problem", ""},
+	// Home while the EV is plugged in, for presence automations. Disabled
+	// unless asked for.
+	{"device_tracker", "ev_tracker", "EV", "", "", ""},
+	// Commanded on cmnd/<topic>/ENABLE.
+	{"switch", "enable", "EV Control Enabled", "", "switch", ""},
+}
+
+// haEnumOptions lists every possible value of the "enum" entities, by id.
+var haEnumOptions = map[string][]string{
+	"operation_mode": {
+		OperationSelfConsumption.String(), OperationAutonomous.String(), OperationBackup.String(), OperationUnknown.String(),
+	},
+}
+
+// ParseHAIcons parses "<entity id>=<icon>" pairs separated by commas, like
+// "ev_budget=mdi:ev-station,boost_remaining=mdi:rocket".
+func ParseHAIcons(s string) (map[string]string, error) {
+	icons := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		id, icon, ok := strings.Cut(pair, "=")
+		if !ok || icon == "" {
+			return nil, fmt.Errorf("expected <entity id>=<icon>, got %q", pair)
+		}
+
+		if !isHAEntity(id) {
+			return nil, fmt.Errorf("unknown entity %q", id)
+		}
+		icons[id] = icon
+	}
+	return icons, nil
+}
+
+// ParseHAMinIntervals parses "<entity id>=<duration>" pairs separated by
+// commas, like "solar_power=30s,load_power=30s".
+func ParseHAMinIntervals(s string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		id, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected <entity id>=<duration>, got %q", pair)
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid interval %q for %s", v, id)
+		}
+
+		if !isHAEntity(id) {
+			return nil, fmt.Errorf("unknown entity %q", id)
+		}
+		intervals[id] = d
+	}
+	return intervals, nil
+}
+
+// ParseHADisabled parses a comma separated list of entity ids, like
+// "evse_temperature,battery_export".
+func ParseHADisabled(s string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if !isHAEntity(id) {
+			return nil, fmt.Errorf("unknown entity %q", id)
+		}
+		disabled[id] = true
+	}
+	return disabled, nil
+}
+
+func isHAEntity(id string) bool {
+	for _, e := range haEntities {
+		if e.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// publishDiscovery publishes retained discovery messages for all haEntities.
+// It is safe to call repeatedly - Home Assistant treats an identical config
+// message as a no-op. All entities are attempted even if some fail.
+func (r *MQTTReporter) publishDiscovery() error {
+	var firstErr error
+	for _, e := range haEntities {
+		var err error
+		if r.Disabled[e.id] {
+			err = r.removeDiscoveryMessage(e.component, e.id)
+		} else {
+			err = r.publishDiscoveryMessage(e.component, e.id, r.discoveryMessage(e))
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("discovery for %s: %w", e.id, err)
+		}
+	}
+
+	return firstErr
+}
+
+// Subscribe subscribes to topic and remembers the subscription so it can be
+// restored after a reconnect (the broker drops subscriptions with a clean
+// session).
+func (r *MQTTReporter) Subscribe(topic string, handler mqtt.MessageHandler) error {
+	r.lock.Lock()
+	r.subscriptions[topic] = handler
+	r.lock.Unlock()
+
+	token := r.client.Subscribe(topic, 1, handler)
+	_ = token.Wait()
+	return token.Error()
+}
+
+// OnConnect is called on every (re)connect to the broker. The broker may have
+// lost retained messages, so availability and discovery are published again.
+func (r *MQTTReporter) OnConnect() {
+	token := r.client.Publish(AvailabilityTopic(r.topic), 1, true, "online")
+	_ = token.Wait()
+	if err := token.Error(); err != nil {
+		log.Printf("Error publishing availability: %v", err)
+	}
+
+	if err := r.publishDiscovery(); err != nil {
+		log.Printf("Error publishing Home Assistant discovery messages: %v", err)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for topic, handler := range r.subscriptions {
+		token := r.client.Subscribe(topic, 1, handler)
+		_ = token.Wait()
+		if err := token.Error(); err != nil {
+			log.Printf("Error resubscribing to %s: %v", topic, err)
+		}
+	}
+}
+
+// Republish publishes availability and discovery again, like after a
+// reconnect. With clearValues, every value is also published again on its
+// next report even if unchanged, for when Home Assistant lost retained state.
+func (r *MQTTReporter) Republish(clearValues bool) error {
+	token := r.client.Publish(AvailabilityTopic(r.topic), 1, true, "online")
+	_ = token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("availability: %w", err)
+	}
+
+	if err := r.publishDiscovery(); err != nil {
+		return err
+	}
+
+	if clearValues {
+		// Not dropped when the queue is full, unlike values.
+		r.queue <- mqttMessage{reset: true}
+	}
+	return nil
+}
+
+func (r *MQTTReporter) PublishLoop() {
+	for msg := range r.queue {
+		r.updateQueueDepth()
+		r.publish(msg)
+	}
+}
+
+// publish publishes msg unless it is unchanged (and not due for a heartbeat)
+// or changed too recently. Only called from PublishLoop.
+func (r *MQTTReporter) publish(msg mqttMessage) {
+	if msg.reset {
+		r.lastSeenValues = make(map[string]string)
+		r.lastPublishedAt = make(map[string]time.Time)
+		return
+	}
+
+	now := r.now()
+	if r.lastSeenValues[msg.topic] == msg.payload &&
+		(r.HeartbeatInterval == 0 || now.Sub(r.lastPublishedAt[msg.topic]) < r.HeartbeatInterval) {
+		return
+	}
+	if msg.minInterval > 0 && now.Sub(r.lastPublishedAt[msg.topic]) < msg.minInterval {
+		return
+	}
+
+	token := r.client.Publish(msg.topic, 0, msg.retained, msg.payload)
+	_ = token.Wait()
+	if err := token.Error(); err != nil {
+		log.Printf("Error publishing to %s: %v", msg.topic, err)
+		return
+	}
+	r.lastSeenValues[msg.topic] = msg.payload
+	r.lastPublishedAt[msg.topic] = now
+}
+
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func (r *MQTTReporter) report(id string, payload string) {
+	if r.Disabled[id] {
+		return
+	}
+	r.enqueue(mqttMessage{topic: r.stateTopic(id), payload: payload, minInterval: r.MinIntervals[id]})
+	if r.LastUpdated {
+		attributes := fmt.Sprintf(`{"last_updated":%q}`, r.now().Format(time.RFC3339))
+		r.enqueue(mqttMessage{topic: r.attributesTopic(id), payload: attributes, minInterval: r.MinIntervals[id]})
+	}
+}
+
+// Heartbeat publishes "online" to the availability topic (at most once per
+// heartbeat interval). It is called from the poll loop, so Home Assistant
+// notices a wedged process even though the LWT never fires.
+func (r *MQTTReporter) Heartbeat() {
+	r.enqueue(mqttMessage{topic: AvailabilityTopic(r.topic), payload: "online", retained: true})
+}
+
+func (r *MQTTReporter) enqueue(msg mqttMessage) {
+	select {
+	case r.queue <- msg:
+		r.updateQueueDepth()
+	default:
+		// Don't block the poll/control loops on a slow broker. The value will be
+		// published again on the next report since lastSeenValues wasn't updated.
+		if r.DroppedCounter != nil {
+			r.DroppedCounter.Inc()
+		}
+	}
+}
+
+func (r *MQTTReporter) updateQueueDepth() {
+	if r.QueueDepthGauge != nil {
+		r.QueueDepthGauge.Set(float64(len(r.queue)))
+	}
+}
+
+// formatFloat formats v with precision decimals, avoiding "-0" for tiny
+// negative values like -0.2 W.
+func formatFloat(v float64, precision int) string {
+	if precision < 0 {
+		precision = 0
+	}
+	s := strconv.FormatFloat(v, 'f', precision, 64)
+	if strings.TrimLeft(s, "-0.") == "" {
+		s = strings.TrimPrefix(s, "-")
+	}
+	return s
+}
+
+func (r *MQTTReporter) ReportSolarW(solarW float64) {
+	r.report("solar_power", formatFloat(solarW, r.PowerPrecision))
+}
+
+func (r *MQTTReporter) ReportLoadW(loadW float64) {
+	r.report("load_power", formatFloat(loadW, r.PowerPrecision))
+}
+
+func (r *MQTTReporter) ReportGridW(gridW float64) {
+	r.report("grid_power", formatFloat(gridW, r.PowerPrecision))
+}
+
+func (r *MQTTReporter) ReportPowerwallBatteryLevel(percent float64) {
+	r.report("powerwall_battery_level", fmt.Sprintf("%.1f", percent))
+}
+
+func (r *MQTTReporter) ReportBatteryExportW(batteryW float64) {
+	r.report("battery_export", formatFloat(batteryW, r.PowerPrecision))
+}
+
+func (r *MQTTReporter) ReportOperationMode(mode OperationMode) {
+	r.report("operation_mode", mode.String())
+}
+
+func (r *MQTTReporter) ReportBatteryState(state BatteryState) {
+	r.report("battery_state", string(state))
+}
+
+func (r *MQTTReporter) ReportSolarEnergyToday(wh float64) {
+	r.report("solar_energy_today", fmt.Sprintf("%.0f", wh))
+}
+
+func (r *MQTTReporter) ReportEVEnergyToday(wh float64) {
+	r.report("ev_energy_today", fmt.Sprintf("%.0f", wh))
+}
+
+func (r *MQTTReporter) ReportEVSETemperature(temp Temperature) {
+	r.report("evse_temperature", formatFloat(float64(temp)/float64(Celsius), r.TempPrecision))
+}
+
+func (r *MQTTReporter) ReportEVSEDivertMode(mode DivertMode) {
+	r.report("evse_divert_mode", mode.String())
+}
+
+func (r *MQTTReporter) ReportEVSEMaxCurrent(amps int32) {
+	r.report("evse_max_current", fmt.Sprintf("%d", amps))
+}
+
+func (r *MQTTReporter) ReportEVSETempMaxAmps(amps int32) {
+	r.report("evse_temp_max_amps", fmt.Sprintf("%d", amps))
+}
+
+func (r *MQTTReporter) ReportEVSECurrent(milliAmp int64) {
+	r.report("evse_current", fmt.Sprintf("%.1f", float64(milliAmp)/1000))
+}
+
+// ReportEVSECurrentGap publishes how far the EVSE current is below the
+// budget's target current. A lasting gap means the car doesn't take what it
+// is offered.
+func (r *MQTTReporter) ReportEVSECurrentGap(milliAmp int64) {
+	r.report("evse_current_gap", fmt.Sprintf("%.1f", float64(milliAmp)/1000))
+}
+
+// ReportEVSEPilotMismatch publishes how much less the car draws than the EVSE
+// offers, or "None" (unknown to Home Assistant) without a car or pilot reading.
+func (r *MQTTReporter) ReportEVSEPilotMismatch(milliAmp int64, ok bool) {
+	if !ok {
+		r.report("evse_pilot_mismatch", "None")
+		return
+	}
+	r.report("evse_pilot_mismatch", fmt.Sprintf("%.1f", float64(milliAmp)/1000))
+}
+
+// ReportEVSEPowerFactor publishes the power factor, or "None" (unknown to Home
+// Assistant) when nothing is flowing. Whether it is an estimate (see
+// EVSEStatus.PowerFactor) is published separately.
+func (r *MQTTReporter) ReportEVSEPowerFactor(pf float64, estimated bool, ok bool) {
+	if !ok {
+		r.report("evse_power_factor", "None")
+		r.report("evse_power_factor_estimated", "None")
+		return
+	}
+	r.report("evse_power_factor", fmt.Sprintf("%.2f", pf))
+	r.report("evse_power_factor_estimated", onOff(estimated))
+}
+
+func (r *MQTTReporter) ReportEVConnected(connected ConnectedType) {
+	r.report("ev_connected", onOff(bool(connected)))
+	if connected {
+		r.report("ev_tracker", "home")
+	} else {
+		r.report("ev_tracker", "not_home")
+	}
+}
+
+func (r *MQTTReporter) ReportDataStale(stale bool) {
+	r.report("data_stale", onOff(stale))
+}
+
+func (r *MQTTReporter) ReportEnabled(enabled bool) {
+	r.report("enable", onOff(enabled))
+}
+
+func (r *MQTTReporter) ReportBudget(budgetW int32) {
+	r.report("ev_budget", fmt.Sprintf("%d", budgetW))
+}
+
+func (r *MQTTReporter) ReportBudgetReason(reason BudgetReason) {
+	r.report("budget_reason", string(reason))
+}
+
+func (r *MQTTReporter) ReportBoostRemaining(remaining time.Duration) {
+	r.report("boost_remaining", fmt.Sprintf("%.0f", remaining.Minutes()))
+}
+
+func (r *MQTTReporter) ReportBudgetOverride(budgetW int32, until time.Time, active bool) {
+	switch {
+	case !active:
+		r.report("budget_override", "off")
+	case until.IsZero():
+		r.report("budget_override", fmt.Sprintf("%d W", budgetW))
+	default:
+		r.report("budget_override", fmt.Sprintf("%d W until %s", budgetW, until.Format("15:04")))
+	}
+}
+
+// ReportBackupReserveChange publishes an event (not a retained state) when the
+// Powerwall's backup reserve changes, like after an edit in the Tesla app.
+func (r *MQTTReporter) ReportBackupReserveChange(oldPercent, newPercent float64) {
+	b, err := json.Marshal(struct {
+		Old float64 `json:"old"`
+		New float64 `json:"new"`
+	}{oldPercent, newPercent})
+	if err != nil {
+		log.Printf("Error encoding backup reserve change: %v", err)
+		return
+	}
+	r.enqueue(mqttMessage{topic: fmt.Sprintf("%s/event/backup_reserve", r.topic), payload: string(b)})
+}
+
+func (r *MQTTReporter) ReportGridServicesToday(active time.Duration, events int) {
+	r.report("grid_services_active_today", fmt.Sprintf("%.0f", active.Seconds()))
+	r.report("grid_services_events_today", fmt.Sprintf("%d", events))
+}
+
+func (r *MQTTReporter) ReportOffPeak(offPeak bool) {
+	r.report("off_peak", onOff(offPeak))
+}
+
+func (r *MQTTReporter) ReportMinutesUntilOffPeak(minutes int64) {
+	r.report("minutes_until_off_peak", fmt.Sprintf("%d", minutes))
+}
@@ -0,0 +1,455 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeMQTT records what is published and subscribed. The embedded Client is
+// nil, so anything else the reporter calls panics.
+type fakeMQTT struct {
+	mqtt.Client
+
+	lock          sync.Mutex
+	published     []fakePublish
+	subscriptions []string
+	err           error // Returned by every Publish
+}
+
+type fakePublish struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+func (f *fakeMQTT) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return &fakeToken{err: f.err}
+	}
+
+	p := fakePublish{topic: topic, retained: retained}
+	switch payload := payload.(type) {
+	case string:
+		p.payload = payload
+	case []byte:
+		p.payload = string(payload)
+	default:
+		panic(fmt.Sprintf("unexpected payload type %T", payload))
+	}
+	f.published = append(f.published, p)
+	return &fakeToken{}
+}
+
+func (f *fakeMQTT) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.subscriptions = append(f.subscriptions, topic)
+	return &fakeToken{}
+}
+
+// take returns what was published since the last call.
+func (f *fakeMQTT) take() []fakePublish {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	published := f.published
+	f.published = nil
+	return published
+}
+
+// payloads returns the payloads published to topic since the last take.
+func (f *fakeMQTT) payloads(topic string) []string {
+	var payloads []string
+	for _, p := range f.take() {
+		if p.topic == topic {
+			payloads = append(payloads, p.payload)
+		}
+	}
+	return payloads
+}
+
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func newTestReporter() (*MQTTReporter, *fakeMQTT, *testClock) {
+	client := &fakeMQTT{}
+	r := NewMQTTReporter(client, "pw", "homeassistant")
+	clock := &testClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	r.now = clock.Now
+	return r, client, clock
+}
+
+// drain publishes everything queued so far, like PublishLoop.
+func drain(r *MQTTReporter) {
+	for len(r.queue) > 0 {
+		msg := <-r.queue
+		r.updateQueueDepth()
+		r.publish(msg)
+	}
+}
+
+func samePayloads(got, want []string) bool {
+	return strings.Join(got, "|") == strings.Join(want, "|")
+}
+
+func TestPublishChangedValues(t *testing.T) {
+	r, client, _ := newTestReporter()
+
+	for _, w := range []float64{1000, 1000, 1000.2, 1200, 1000} {
+		r.ReportSolarW(w)
+	}
+	r.ReportLoadW(1000)
+	drain(r)
+
+	published := client.take()
+	var solar, load []string
+	for _, p := range published {
+		switch p.topic {
+		case "pw/solar_power":
+			solar = append(solar, p.payload)
+		case "pw/load_power":
+			load = append(load, p.payload)
+		default:
+			t.Errorf("unexpected publish to %s", p.topic)
+		}
+		if p.retained {
+			t.Errorf("value published to %s was retained", p.topic)
+		}
+	}
+	if want := []string{"1000", "1200", "1000"}; !samePayloads(solar, want) {
+		t.Errorf("solar_power published %q, want %q", solar, want)
+	}
+	if want := []string{"1000"}; !samePayloads(load, want) {
+		t.Errorf("load_power published %q, want %q", load, want)
+	}
+}
+
+func TestPublishFailureRetried(t *testing.T) {
+	r, client, _ := newTestReporter()
+
+	client.err = errors.New("not connected")
+	r.ReportSolarW(1000)
+	drain(r)
+
+	client.err = nil
+	r.ReportSolarW(1000)
+	drain(r)
+	if got := client.payloads("pw/solar_power"); !samePayloads(got, []string{"1000"}) {
+		t.Errorf("after a failed publish, published %q, want the value again", got)
+	}
+}
+
+func TestPublishMinInterval(t *testing.T) {
+	r, client, clock := newTestReporter()
+	r.MinIntervals = map[string]time.Duration{"solar_power": 30 * time.Second}
+
+	for _, step := range []struct {
+		at     time.Duration
+		solarW float64
+		want   []string
+	}{
+		{0, 1000, []string{"1000"}},
+		{10 * time.Second, 1100, nil},
+		{20 * time.Second, 1200, nil},
+		{30 * time.Second, 1300, []string{"1300"}}, // The latest value once the interval is up
+		{40 * time.Second, 1300, nil},
+		{90 * time.Second, 1300, nil}, // Unchanged
+		{100 * time.Second, 1400, []string{"1400"}},
+	} {
+		clock.now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC).Add(step.at)
+		r.ReportSolarW(step.solarW)
+		drain(r)
+
+		if got := client.payloads("pw/solar_power"); !samePayloads(got, step.want) {
+			t.Errorf("at +%s: solar_power published %q, want %q", step.at, got, step.want)
+		}
+	}
+}
+
+func TestPublishHeartbeat(t *testing.T) {
+	r, client, clock := newTestReporter()
+	r.HeartbeatInterval = time.Minute
+
+	for _, step := range []struct {
+		at   time.Duration
+		want []string
+	}{
+		{0, []string{"1000"}},
+		{30 * time.Second, nil},
+		{59 * time.Second, nil},
+		{60 * time.Second, []string{"1000"}},
+		{90 * time.Second, nil},
+		{120 * time.Second, []string{"1000"}},
+	} {
+		clock.now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC).Add(step.at)
+		r.ReportSolarW(1000)
+		r.Heartbeat()
+		drain(r)
+
+		published := client.take()
+		var solar, online []string
+		for _, p := range published {
+			switch p.topic {
+			case "pw/solar_power":
+				solar = append(solar, p.payload)
+			case "pw/availability":
+				online = append(online, p.payload)
+				if !p.retained {
+					t.Errorf("availability wasn't retained")
+				}
+			}
+		}
+		if !samePayloads(solar, step.want) {
+			t.Errorf("at +%s: solar_power published %q, want %q", step.at, solar, step.want)
+		}
+		if len(online) != len(step.want) {
+			t.Errorf("at +%s: availability published %q, want it with the heartbeat", step.at, online)
+		}
+	}
+}
+
+func TestRepublishClearsValues(t *testing.T) {
+	r, client, _ := newTestReporter()
+
+	r.ReportSolarW(1000)
+	drain(r)
+	client.take()
+
+	if err := r.Republish(false); err != nil {
+		t.Fatalf("Republish(false): %v", err)
+	}
+	r.ReportSolarW(1000)
+	drain(r)
+	if got := client.payloads("pw/solar_power"); got != nil {
+		t.Errorf("Republish(false) then an unchanged report published %q", got)
+	}
+
+	if err := r.Republish(true); err != nil {
+		t.Fatalf("Republish(true): %v", err)
+	}
+	r.ReportSolarW(1000)
+	drain(r)
+	if got := client.payloads("pw/solar_power"); !samePayloads(got, []string{"1000"}) {
+		t.Errorf("Republish(true) then an unchanged report published %q, want the value again", got)
+	}
+}
+
+func TestEnqueueQueueFull(t *testing.T) {
+	r, client, _ := newTestReporter()
+	r.QueueDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth"})
+	r.DroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"})
+
+	// Nothing is draining the queue, like with a slow broker.
+	size := cap(r.queue)
+	for i := 0; i < size+5; i++ {
+		r.ReportSolarW(float64(i))
+	}
+
+	if got := testutil.ToFloat64(r.DroppedCounter); got != 5 {
+		t.Errorf("dropped %v messages, want 5", got)
+	}
+	if got := testutil.ToFloat64(r.QueueDepthGauge); got != float64(size) {
+		t.Errorf("queue depth = %v, want %d", got, size)
+	}
+
+	// The values that made it into the queue are published, and the next
+	// report publishes the latest value.
+	drain(r)
+	if got := client.payloads("pw/solar_power"); len(got) != size || got[size-1] != fmt.Sprint(size-1) {
+		t.Errorf("published %d values ending with %q, want %d ending with %q", len(got), got[len(got)-1], size, fmt.Sprint(size-1))
+	}
+	r.ReportSolarW(float64(size + 4))
+	drain(r)
+	if got := client.payloads("pw/solar_power"); !samePayloads(got, []string{fmt.Sprint(size + 4)}) {
+		t.Errorf("after the queue drained, published %q, want the latest value", got)
+	}
+	if got := testutil.ToFloat64(r.QueueDepthGauge); got != 0 {
+		t.Errorf("queue depth after draining = %v, want 0", got)
+	}
+}
+
+func TestReportDisabled(t *testing.T) {
+	r, client, _ := newTestReporter()
+	r.Disabled = map[string]bool{"solar_power": true}
+
+	r.ReportSolarW(1000)
+	r.ReportLoadW(1000)
+	drain(r)
+	for _, p := range client.take() {
+		if p.topic == "pw/solar_power" {
+			t.Errorf("disabled entity published %q", p.payload)
+		}
+	}
+}
+
+func TestReportLastUpdated(t *testing.T) {
+	r, client, _ := newTestReporter()
+	r.LastUpdated = true
+
+	r.ReportSolarW(1000)
+	drain(r)
+	if got := client.payloads("pw/solar_power/attributes"); !samePayloads(got, []string{`{"last_updated":"2024-06-01T12:00:00Z"}`}) {
+		t.Errorf("attributes published %q", got)
+	}
+}
+
+func TestOnConnectDiscovery(t *testing.T) {
+	r, client, _ := newTestReporter()
+	r.HeartbeatInterval = time.Minute
+	r.NamePrefix = "Garage "
+	r.Icons = map[string]string{"ev_budget": "mdi:ev-station"}
+	r.Disabled = map[string]bool{"ev_tracker": true}
+	if err := r.Subscribe("cmnd/pw/POLL", func(mqtt.Client, mqtt.Message) {}); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	r.OnConnect()
+
+	configs := make(map[string]string)
+	var online int
+	for _, p := range client.take() {
+		if p.topic == "pw/availability" {
+			online++
+			continue
+		}
+		if !strings.HasPrefix(p.topic, "homeassistant/") {
+			t.Errorf("unexpected publish to %s", p.topic)
+			continue
+		}
+		if !p.retained {
+			t.Errorf("discovery for %s wasn't retained", p.topic)
+		}
+		if _, ok := configs[p.topic]; ok {
+			t.Errorf("discovery for %s sent more than once", p.topic)
+		}
+		configs[p.topic] = p.payload
+	}
+	if online != 1 {
+		t.Errorf("availability published %d times, want 1", online)
+	}
+	if len(configs) != len(haEntities) {
+		t.Errorf("discovery sent for %d entities, want %d", len(configs), len(haEntities))
+	}
+
+	config := func(component, id string) haDiscoveryMessage {
+		t.Helper()
+		payload, ok := configs[fmt.Sprintf("homeassistant/%s/pw/%s/config", component, id)]
+		if !ok {
+			t.Fatalf("no discovery for %s %s", component, id)
+		}
+		var msg haDiscoveryMessage
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			t.Fatalf("decoding discovery for %s: %v", id, err)
+		}
+		return msg
+	}
+
+	if got := config("sensor", "solar_power"); got.Name != "Garage Solar Power" || got.UniqueID != "pw_solar_power" ||
+		got.StateTopic != "pw/solar_power" || got.AvailabilityTopic != "pw/availability" ||
+		got.UnitOfMeasurement != "W" || got.DeviceClass != "power" || got.StateClass != "measurement" ||
+		got.ExpireAfter != 180 || got.Device.Identifiers[0] != "pw" {
+		t.Errorf("solar_power discovery = %+v", got)
+	}
+	if got := config("sensor", "ev_budget"); got.Icon != "mdi:ev-station" {
+		t.Errorf("ev_budget icon = %q, want mdi:ev-station", got.Icon)
+	}
+	if got := config("sensor", "operation_mode"); len(got.Options) != 4 || got.StateClass != "" {
+		t.Errorf("operation_mode discovery = %+v, want enum options and no state class", got)
+	}
+	if got := config("binary_sensor", "ev_connected"); got.PayloadOn != "ON" || got.PayloadOff != "OFF" || got.UnitOfMeasurement != "" {
+		t.Errorf("ev_connected discovery = %+v", got)
+	}
+	if got := config("switch", "enable"); got.CommandTopic != "cmnd/pw/ENABLE" || got.ExpireAfter != 0 {
+		t.Errorf("enable discovery = %+v, want a command topic and no expiry", got)
+	}
+	if payload := configs["homeassistant/device_tracker/pw/ev_tracker/config"]; payload != "" {
+		t.Errorf("disabled ev_tracker discovery = %q, want it cleared", payload)
+	}
+
+	if want := []string{"cmnd/pw/POLL", "cmnd/pw/POLL"}; !samePayloads(client.subscriptions, want) {
+		t.Errorf("subscriptions = %q, want %q restored on connect", client.subscriptions, want)
+	}
+}
+
+func TestDiscoveryErrors(t *testing.T) {
+	r, client, _ := newTestReporter()
+	client.err = errors.New("not connected")
+
+	if err := r.Republish(false); err == nil {
+		t.Errorf("Republish succeeded with every publish failing")
+	}
+	if err := r.publishDiscovery(); err == nil || !strings.Contains(err.Error(), haEntities[0].id) {
+		t.Errorf("publishDiscovery = %v, want the first entity's error", err)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	for _, tc := range []struct {
+		v         float64
+		precision int
+		want      string
+	}{
+		{1234.56, 0, "1235"},
+		{1234.56, 1, "1234.6"},
+		{1234.56, 2, "1234.56"},
+		{-1234.4, 0, "-1234"},
+		{-0.2, 0, "0"}, // Not "-0"
+		{-0.04, 1, "0.0"},
+		{-0.05, 1, "-0.1"},
+		{0, 0, "0"},
+		{42.5, -1, "42"}, // Negative precision is treated as 0
+	} {
+		if got := formatFloat(tc.v, tc.precision); got != tc.want {
+			t.Errorf("formatFloat(%v, %d) = %q, want %q", tc.v, tc.precision, got, tc.want)
+		}
+	}
+}
+
+func TestReportPrecision(t *testing.T) {
+	r, client, _ := newTestReporter()
+
+	r.ReportEVSETemperature(455)
+	r.ReportSolarW(1234.56)
+	drain(r)
+	if got := client.payloads("pw/evse_temperature"); !samePayloads(got, []string{"45.5"}) {
+		t.Errorf("default precision: evse_temperature published %q, want 45.5", got)
+	}
+
+	r, client, _ = newTestReporter()
+	r.TempPrecision = 0
+	r.PowerPrecision = 1
+	r.ReportEVSETemperature(455)
+	r.ReportSolarW(1234.56)
+	drain(r)
+	published := client.take()
+	want := map[string]string{"pw/evse_temperature": "46", "pw/solar_power": "1234.6"}
+	for _, p := range published {
+		if p.payload != want[p.topic] {
+			t.Errorf("%s published %q, want %q", p.topic, p.payload, want[p.topic])
+		}
+	}
+	if len(published) != len(want) {
+		t.Errorf("published %d values, want %d", len(published), len(want))
+	}
+}
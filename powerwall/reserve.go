@@ -0,0 +1,119 @@
+package powerwall
+
+import "log"
+
+// ReserveOverrides is the single owner of temporary backup reserve changes,
+// so actions whose events overlap don't restore each other's reserve. The
+// most recently pushed override applies, and the reserve from before the
+// first one is restored once none are left. Only accessed from the poll loop.
+type ReserveOverrides struct {
+	client *TeslaClient
+	dryRun bool
+
+	stack []reserveOverride
+	saved float64 // Reserve to restore once the stack is empty
+
+	lastSet     float64 // Reserve most recently written to the gateway, until taken
+	haveLastSet bool
+}
+
+type reserveOverride struct {
+	owner   string
+	percent float64
+}
+
+func NewReserveOverrides(client *TeslaClient, dryRun bool) *ReserveOverrides {
+	return &ReserveOverrides{
+		client: client,
+		dryRun: dryRun,
+	}
+}
+
+// Push applies percent on behalf of owner, replacing any override owner
+// already has.
+func (r *ReserveOverrides) Push(owner string, percent float64) error {
+	if len(r.stack) == 0 {
+		op, err := r.client.GetOperation()
+		if err != nil {
+			return err
+		}
+		r.saved = op.BackupReservePercent
+	}
+
+	log.Printf("%s: setting Powerwall reserve to %.0f%%", owner, percent)
+	if err := r.set(percent); err != nil {
+		return err
+	}
+	r.remove(owner)
+	r.stack = append(r.stack, reserveOverride{owner: owner, percent: percent})
+	return nil
+}
+
+// Pop drops owner's override, applying the one below it or restoring the
+// original reserve.
+func (r *ReserveOverrides) Pop(owner string) error {
+	wasTop := len(r.stack) > 0 && r.stack[len(r.stack)-1].owner == owner
+	if !r.remove(owner) || !wasTop {
+		// Something else is still in charge of the reserve.
+		return nil
+	}
+
+	if len(r.stack) > 0 {
+		next := r.stack[len(r.stack)-1]
+		log.Printf("%s ended, Powerwall reserve back to %.0f%% for %s", owner, next.percent, next.owner)
+		return r.set(next.percent)
+	}
+
+	log.Printf("%s ended, restoring Powerwall reserve to %.0f%%", owner, r.saved)
+	return r.set(r.saved)
+}
+
+// Active reports whether owner has an override.
+func (r *ReserveOverrides) Active(owner string) bool {
+	for _, o := range r.stack {
+		if o.owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// Current returns the reserve the overrides are holding, if any.
+func (r *ReserveOverrides) Current() (float64, bool) {
+	if len(r.stack) == 0 {
+		return 0, false
+	}
+	return r.stack[len(r.stack)-1].percent, true
+}
+
+// TakeLastSet returns the reserve most recently written to the gateway,
+// including restores, so changes made here can be told apart from outside
+// ones. It is forgotten once taken: call it on every poll, so a later
+// outside change back to the same value isn't mistaken for one made here.
+func (r *ReserveOverrides) TakeLastSet() (float64, bool) {
+	percent, ok := r.lastSet, r.haveLastSet
+	r.lastSet, r.haveLastSet = 0, false
+	return percent, ok
+}
+
+func (r *ReserveOverrides) remove(owner string) bool {
+	for i, o := range r.stack {
+		if o.owner == owner {
+			r.stack = append(r.stack[:i], r.stack[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ReserveOverrides) set(percent float64) error {
+	if r.dryRun {
+		log.Printf("[DRY RUN] Setting Powerwall reserve to %.0f%%", percent)
+		return nil
+	}
+	if err := r.client.SetBackupReserve(percent); err != nil {
+		return err
+	}
+	r.lastSet, r.haveLastSet = percent, true
+	return nil
+}
@@ -0,0 +1,196 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// gatewayReserve returns the backup reserve last posted to g, or -1 if none
+// was.
+func gatewayReserve(t *testing.T, g *fakeGateway) float64 {
+	t.Helper()
+	body := g.postedBody("/api/operation")
+	if body == nil {
+		return -1
+	}
+	var op struct {
+		BackupReservePercent float64 `json:"backup_reserve_percent"`
+	}
+	if err := json.Unmarshal(body, &op); err != nil {
+		t.Fatalf("decoding posted operation: %v", err)
+	}
+	return op.BackupReservePercent
+}
+
+func newReserveTest(t *testing.T) (*fakeGateway, *TeslaClient) {
+	g := newFakeGateway(t)
+	g.respond("/api/operation", `{"real_mode":"self_consumption","backup_reserve_percent":20}`)
+	g.respond("/api/config/completed", `{}`)
+	c, _ := loggedInClient(t, g)
+	return g, c
+}
+
+func TestReserveOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		steps []string // "+owner" pushes, "-owner" pops
+		want  []float64
+	}{
+		{
+			name:  "single",
+			steps: []string{"+a", "-a"},
+			want:  []float64{80, 20},
+		},
+		{
+			name:  "last pushed ends first",
+			steps: []string{"+a", "+b", "-b", "-a"},
+			want:  []float64{80, 50, 80, 20},
+		},
+		{
+			name:  "first pushed ends first",
+			steps: []string{"+a", "+b", "-a", "-b"},
+			want:  []float64{80, 50, 50, 20},
+		},
+		{
+			name:  "push again",
+			steps: []string{"+a", "+b", "+a", "-a", "-b"},
+			want:  []float64{80, 50, 80, 50, 20},
+		},
+		{
+			name:  "pop without push",
+			steps: []string{"-a", "+b", "-a", "-b"},
+			want:  []float64{-1, 50, 50, 20},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, c := newReserveTest(t)
+			r := NewReserveOverrides(c, false)
+			percents := map[string]float64{"a": 80, "b": 50}
+
+			for i, step := range tc.steps {
+				owner := step[1:]
+				var err error
+				if step[0] == '+' {
+					err = r.Push(owner, percents[owner])
+				} else {
+					err = r.Pop(owner)
+				}
+				if err != nil {
+					t.Fatalf("step %d (%s): %v", i, step, err)
+				}
+				if got := gatewayReserve(t, g); got != tc.want[i] {
+					t.Errorf("after step %d (%s): gateway reserve = %.0f, want %.0f", i, step, got, tc.want[i])
+				}
+			}
+
+			if _, ok := r.Current(); ok {
+				t.Errorf("overrides still held after the last pop")
+			}
+			if last, ok := r.TakeLastSet(); ok && last != gatewayReserve(t, g) {
+				t.Errorf("TakeLastSet = %.0f, but the gateway has %.0f", last, gatewayReserve(t, g))
+			}
+		})
+	}
+}
+
+func TestReserveOverridesDryRun(t *testing.T) {
+	g, c := newReserveTest(t)
+	r := NewReserveOverrides(c, true)
+
+	if err := r.Push("a", 80); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if current, ok := r.Current(); !ok || current != 80 {
+		t.Errorf("Current = %.0f, %t, want 80", current, ok)
+	}
+	if err := r.Pop("a"); err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+	if g.postedBody("/api/operation") != nil {
+		t.Errorf("dry run changed the gateway's reserve")
+	}
+	if _, ok := r.TakeLastSet(); ok {
+		t.Errorf("dry run recorded a reserve as set")
+	}
+}
+
+func TestReserveOverridesTakeLastSet(t *testing.T) {
+	_, c := newReserveTest(t)
+	r := NewReserveOverrides(c, false)
+
+	if _, ok := r.TakeLastSet(); ok {
+		t.Errorf("TakeLastSet before anything was set returned a reserve")
+	}
+	if err := r.Push("a", 80); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if last, ok := r.TakeLastSet(); !ok || last != 80 {
+		t.Errorf("TakeLastSet = %.0f, %t, want 80", last, ok)
+	}
+	// Taken by the poll that saw it, so a later change to 80 isn't ours.
+	if last, ok := r.TakeLastSet(); ok {
+		t.Errorf("TakeLastSet again = %.0f, want nothing", last)
+	}
+
+	if err := r.Pop("a"); err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+	if last, ok := r.TakeLastSet(); !ok || last != 20 {
+		t.Errorf("TakeLastSet after the restore = %.0f, %t, want 20", last, ok)
+	}
+}
+
+// Grid services events and battery protection overlap, and whichever ends
+// last restores the reserve from before either started.
+func TestReserveActionsOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		gridEndsFirst bool
+		want          []float64 // After protection starts, an event starts, the first ends, the second ends
+	}{
+		{"event ends first", true, []float64{50, 100, 50, 20}},
+		{"protection ends first", false, []float64{50, 100, 100, 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, c := newReserveTest(t)
+			reserve := NewReserveOverrides(c, false)
+			protect := NewBatteryProtectAction(c, reserve, 50)
+			grid := NewGridServicesAction(c, reserve, 100, OperationUnknown, false)
+
+			steps := []func() error{
+				func() error { return protect.Update(true) },
+				func() error { return grid.Update(true) },
+				func() error { return protect.Update(false) },
+				func() error { return grid.Update(false) },
+			}
+			if tc.gridEndsFirst {
+				steps[2], steps[3] = steps[3], steps[2]
+			}
+
+			for i, step := range steps {
+				if err := step(); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if got := gatewayReserve(t, g); got != tc.want[i] {
+					t.Errorf("after step %d: gateway reserve = %.0f, want %.0f", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatteryProtectActionReserveAlreadyHigher(t *testing.T) {
+	g, c := newReserveTest(t)
+	g.respond("/api/operation", `{"real_mode":"self_consumption","backup_reserve_percent":60}`)
+	protect := NewBatteryProtectAction(c, NewReserveOverrides(c, false), 50)
+
+	if err := protect.Update(true); err != nil {
+		t.Fatalf("Update(true): %v", err)
+	}
+	if err := protect.Update(false); err != nil {
+		t.Fatalf("Update(false): %v", err)
+	}
+	if g.postedBody("/api/operation") != nil {
+		t.Errorf("reserve was changed although it was already above the protection reserve")
+	}
+}
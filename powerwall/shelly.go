@@ -0,0 +1,66 @@
+package powerwall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ShellyEMClient reads grid power from a Shelly EM (Gen1 /status API). It can
+// replace the Powerwall's site meter when the Shelly's CT clamp is at the main
+// panel.
+type ShellyEMClient struct {
+	client     *http.Client
+	url        string
+	channel    int
+	powerGauge *prometheus.GaugeVec
+}
+
+func NewShellyEMClient(client *http.Client, url string, channel int, powerGauge *prometheus.GaugeVec) *ShellyEMClient {
+	return &ShellyEMClient{
+		client:     client,
+		url:        url,
+		channel:    channel,
+		powerGauge: powerGauge,
+	}
+}
+
+type shellyEMStatus struct {
+	EMeters []struct {
+		Power   float64 `json:"power"` // W, positive when importing
+		IsValid bool    `json:"is_valid"`
+	} `json:"emeters"`
+}
+
+// GetGridPowerW returns grid power in W, positive when importing from the grid
+// (same sign as the Powerwall's site meter).
+func (c *ShellyEMClient) GetGridPowerW() (float64, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", c.url, resp.Status)
+	}
+
+	var status shellyEMStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+
+	if c.channel >= len(status.EMeters) {
+		return 0, fmt.Errorf("Shelly EM reported %d meters, want channel %d", len(status.EMeters), c.channel)
+	}
+
+	meter := status.EMeters[c.channel]
+	if !meter.IsValid {
+		return 0, fmt.Errorf("Shelly EM channel %d reading is not valid", c.channel)
+	}
+
+	c.powerGauge.WithLabelValues("grid-meter").Set(meter.Power)
+	return meter.Power, nil
+}
@@ -0,0 +1,587 @@
+package powerwall
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/publicsuffix"
+)
+
+type TeslaClient struct {
+	client                   *http.Client
+	gatewayAddr              string
+	password                 string
+	Username                 string // Local login, "customer" unless provisioned differently
+	Email                    string
+	debug                    bool
+	batteryLevelGauge        *prometheus.GaugeVec
+	energyExportedGauge      *prometheus.GaugeVec
+	energyImportedGauge      *prometheus.GaugeVec
+	energyLevelsGauge        *prometheus.GaugeVec
+	gridServicesEnabledGauge *prometheus.GaugeVec
+	powerGauge               *prometheus.GaugeVec
+	Limiter                  *RateLimiter
+	Timeout                  time.Duration   // Per-request timeout, including reading the body
+	DisabledMeters           map[string]bool // Meters not exported to Prometheus
+	Proxy                    *url.URL        // Overrides HTTP_PROXY/HTTPS_PROXY if set
+	MaxBodyBytes             int64           // Larger responses (after decompression) are rejected
+	soe                      soeFilter       // Only accessed from the poll loop
+
+	payloadsLock sync.Mutex
+	lastPayloads map[string]json.RawMessage // Last response body by API path
+}
+
+// newHTTPClient returns a client for the gateway. Requests go through proxy
+// (http, https or socks5) if set, and through HTTP_PROXY/HTTPS_PROXY otherwise.
+func newHTTPClient(timeout time.Duration, proxy *url.URL) *http.Client {
+	// Should never fail
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != nil {
+		proxyFunc = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{
+		Jar:     jar,
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           proxyFunc,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// The gateway's local "customer" login doesn't check the email.
+const (
+	DefaultTeslaUsername = "customer"
+	DefaultTeslaEmail    = "hello@example.com"
+)
+
+// DefaultMaxBodyBytes is far more than any gateway response, which are a few
+// KB at most.
+const DefaultMaxBodyBytes = 4 << 20
+
+func NewTEGClient(
+	gatewayAddr string, password string, debug bool,
+	batteryLevelGauge, energyExportedGauge, energyImportedGauge, energyLevelsGauge, powerGauge, gridServicesEnabledGauge *prometheus.GaugeVec,
+) *TeslaClient {
+	return &TeslaClient{
+		gatewayAddr:              gatewayAddr,
+		password:                 password,
+		Username:                 DefaultTeslaUsername,
+		Email:                    DefaultTeslaEmail,
+		debug:                    debug,
+		batteryLevelGauge:        batteryLevelGauge,
+		energyExportedGauge:      energyExportedGauge,
+		energyImportedGauge:      energyImportedGauge,
+		energyLevelsGauge:        energyLevelsGauge,
+		powerGauge:               powerGauge,
+		gridServicesEnabledGauge: gridServicesEnabledGauge,
+		MaxBodyBytes:             DefaultMaxBodyBytes,
+	}
+}
+
+func (c *TeslaClient) Login() error {
+	// Clear cookie jar and create a fresh client
+	c.client = newHTTPClient(c.Timeout, c.Proxy)
+
+	var buf bytes.Buffer
+
+	loginReq := struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		Email      string `json:"email"`
+		ForceSmOff bool   `json:"force_sm_off"`
+	}{
+		Username:   c.Username,
+		Password:   c.password,
+		Email:      c.Email,
+		ForceSmOff: false,
+	}
+
+	if err := json.NewEncoder(&buf).Encode(&loginReq); err != nil {
+		// If this fails, there really is no point retrying
+		return err
+	}
+
+	c.Limiter.wait("login")
+	const loginPath = "/api/login/Basic"
+	resp, err := c.client.Post(fmt.Sprintf("https://%s%s", c.gatewayAddr, loginPath), "application/json", &buf)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", loginPath, err)
+	}
+
+	body, err := readBody(resp, c.MaxBodyBytes)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", loginPath, err)
+	}
+
+	return checkResponse(loginPath, resp, body)
+}
+
+// APIError is returned when the gateway responds with a non-2xx status.
+// Network and decoding errors are wrapped with the request path instead.
+type APIError struct {
+	Path       string
+	StatusCode int
+	Body       string // Possibly truncated
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: HTTP %d: %s", e.Path, e.StatusCode, e.Body)
+}
+
+// IsAuthError reports whether err means the gateway rejected our session or
+// credentials, in which case logging in again may help.
+func IsAuthError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+const maxErrorBodyLen = 256
+
+func checkResponse(path string, resp *http.Response, body []byte) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	if len(body) > maxErrorBodyLen {
+		body = body[:maxErrorBodyLen]
+	}
+	return &APIError{Path: path, StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+// readBody reads the response body, decompressing it if needed. The transport
+// requests gzip and decompresses it transparently, so this only matters for
+// gateways that compress without being asked, or use deflate. Bodies over
+// maxBytes are an error rather than being read into memory in full.
+func readBody(resp *http.Response, maxBytes int64) ([]byte, error) {
+	var r io.Reader = resp.Body
+	switch {
+	case resp.Uncompressed:
+	case strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip"):
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.EqualFold(resp.Header.Get("Content-Encoding"), "deflate"):
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("response larger than %d bytes", maxBytes)
+	}
+	return body, nil
+}
+
+func getAPI[T any](c *TeslaClient, path string, result T, reportMetrics func()) error {
+	c.Limiter.wait("GET " + path)
+	resp, err := c.client.Get(fmt.Sprintf("https://%s%s", c.gatewayAddr, path))
+	if err != nil {
+		return fmt.Errorf("GET %s: %w", path, err)
+	}
+
+	defer resp.Body.Close()
+	body, err := readBody(resp, c.MaxBodyBytes)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := checkResponse(path, resp, body); err != nil {
+		return err
+	}
+
+	if c.debug {
+		pretty := &bytes.Buffer{}
+		if err := json.Indent(pretty, body, "", "  "); err != nil {
+			return err
+		}
+		log.Printf("GET %s: %s", path, pretty.String())
+	}
+
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("decoding %s: %w", path, err)
+	}
+	c.recordPayload(path, body)
+
+	if c.debug {
+		log.Printf("%+v", result)
+	}
+	reportMetrics()
+	return nil
+}
+
+func (c *TeslaClient) recordPayload(path string, body []byte) {
+	c.payloadsLock.Lock()
+	defer c.payloadsLock.Unlock()
+	if c.lastPayloads == nil {
+		c.lastPayloads = make(map[string]json.RawMessage)
+	}
+	c.lastPayloads[path] = body
+}
+
+// LastPayloads returns the last successfully decoded response of every API
+// path polled so far, for debugging.
+func (c *TeslaClient) LastPayloads() map[string]json.RawMessage {
+	c.payloadsLock.Lock()
+	defer c.payloadsLock.Unlock()
+	payloads := make(map[string]json.RawMessage, len(c.lastPayloads))
+	for path, body := range c.lastPayloads {
+		payloads[path] = body
+	}
+	return payloads
+}
+
+func postAPI(c *TeslaClient, path string, req interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(req); err != nil {
+		return err
+	}
+
+	c.Limiter.wait("POST " + path)
+	resp, err := c.client.Post(fmt.Sprintf("https://%s%s", c.gatewayAddr, path), "application/json", &buf)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", path, err)
+	}
+
+	defer resp.Body.Close()
+	body, err := readBody(resp, c.MaxBodyBytes)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return checkResponse(path, resp, body)
+}
+
+// KnownMeters are the meters the gateway is known to report in /api/meters/aggregates.
+var KnownMeters = []string{"site", "battery", "load", "solar", "busway", "frequency", "generator"}
+
+func IsKnownMeter(meter string) bool {
+	for _, m := range KnownMeters {
+		if m == meter {
+			return true
+		}
+	}
+	return false
+}
+
+type Meters map[string]struct {
+	InstantPower   float64 `json:"instant_power"`
+	EnergyExported float64 `json:"energy_exported"`
+	EnergyImported float64 `json:"energy_imported"`
+
+	// Per phase currents (A). 0 for phases the meter doesn't measure.
+	CurrentA float64 `json:"i_a_current"`
+	CurrentB float64 `json:"i_b_current"`
+	CurrentC float64 `json:"i_c_current"`
+}
+
+// rawMeters decodes Meters while keeping the response verbatim.
+type rawMeters struct {
+	meters Meters
+	raw    json.RawMessage
+}
+
+func (m *rawMeters) UnmarshalJSON(b []byte) error {
+	m.raw = append(json.RawMessage(nil), b...)
+	return json.Unmarshal(b, &m.meters)
+}
+
+func (c *TeslaClient) GetMeterAggregates() (Meters, error) {
+	metersResp, _, err := c.GetMeterAggregatesRaw()
+	return metersResp, err
+}
+
+// GetMeterAggregatesRaw is like GetMeterAggregates, but also returns the
+// response JSON as sent by the gateway.
+func (c *TeslaClient) GetMeterAggregatesRaw() (Meters, []byte, error) {
+	var metersResp rawMeters
+	err := getAPI(c, "/api/meters/aggregates", &metersResp,
+		func() {
+			for label, v := range metersResp.meters {
+				if c.DisabledMeters[label] {
+					continue
+				}
+				c.energyExportedGauge.WithLabelValues(label).Set(v.EnergyExported)
+				c.energyImportedGauge.WithLabelValues(label).Set(v.EnergyImported)
+				c.powerGauge.WithLabelValues(label).Set(v.InstantPower)
+			}
+		},
+	)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return metersResp.meters, metersResp.raw, nil
+}
+
+type Soe struct {
+	Percentage float64 `json:"percentage"`
+}
+
+// ErrImplausibleSOE is returned by GetStateOfEnergy when the reading is
+// implausible and there is no earlier good one to use instead. Only the state
+// of energy is unknown; the rest of the gateway's data can still be used.
+var ErrImplausibleSOE = errors.New("implausible state of energy")
+
+// soeSuspectReads is how many implausible state of energy readings in a row
+// are needed before they're believed.
+const soeSuspectReads = 3
+
+// soeFilter holds back implausible state of energy readings (0% or above
+// 100%), which the gateway briefly returns while it restarts, unless they
+// persist across soeSuspectReads reads.
+type soeFilter struct {
+	lastGood     float64
+	haveGood     bool
+	suspectReads int
+}
+
+// filter returns the value to use for percent, and false if there is no
+// trustworthy value yet.
+func (f *soeFilter) filter(percent float64) (float64, bool) {
+	if percent > 0 && percent <= 100 {
+		f.lastGood, f.haveGood = percent, true
+		f.suspectReads = 0
+		return percent, true
+	}
+
+	f.suspectReads++
+	if f.suspectReads >= soeSuspectReads {
+		// Not a hiccup - the Powerwall really reports this.
+		f.lastGood, f.haveGood = percent, true
+		return percent, true
+	}
+
+	log.Printf("Ignoring implausible Powerwall state of energy %.1f%% (%d/%d), keeping %.1f%%", percent, f.suspectReads, soeSuspectReads, f.lastGood)
+	return f.lastGood, f.haveGood
+}
+
+func (c *TeslaClient) GetStateOfEnergy() (*Soe, error) {
+	var soeResp Soe
+	err := getAPI(c, "/api/system_status/soe", &soeResp, func() {})
+
+	if err != nil {
+		return nil, err
+	}
+
+	percent, ok := c.soe.filter(soeResp.Percentage)
+	if !ok {
+		return nil, fmt.Errorf("%w %.1f%%", ErrImplausibleSOE, soeResp.Percentage)
+	}
+	c.batteryLevelGauge.WithLabelValues("powerwall").Set(percent)
+	return &Soe{Percentage: percent}, nil
+}
+
+// GatewayStatus identifies the gateway and its firmware.
+type GatewayStatus struct {
+	DIN           string `json:"din"`
+	Version       string `json:"version"`
+	GitHash       string `json:"git_hash"`
+	DeviceType    string `json:"device_type"`
+	UpTimeSeconds string `json:"up_time_seconds"` // A Go duration, like "62h26m41.46s"
+}
+
+// Uptime returns how long the gateway has been running.
+func (s *GatewayStatus) Uptime() (time.Duration, error) {
+	return time.ParseDuration(s.UpTimeSeconds)
+}
+
+func (c *TeslaClient) GetGatewayStatus() (*GatewayStatus, error) {
+	var statusResp GatewayStatus
+	if err := getAPI(c, "/api/status", &statusResp, func() {}); err != nil {
+		return nil, err
+	}
+	return &statusResp, nil
+}
+
+type SystemStatus struct {
+	NominalFullPackEnergyWh  float64 `json:"nominal_full_pack_energy"`
+	NominalEnergyRemainingWh float64 `json:"nominal_energy_remaining"`
+}
+
+func (c *TeslaClient) GetSystemStatus() (*SystemStatus, error) {
+	var systemStatusResp SystemStatus
+	err := getAPI(c, "/api/system_status", &systemStatusResp, func() {
+		c.energyLevelsGauge.WithLabelValues("nominal-full-pack").Set(systemStatusResp.NominalFullPackEnergyWh)
+		c.energyLevelsGauge.WithLabelValues("nominal-energy-remaning").Set(systemStatusResp.NominalEnergyRemainingWh)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return &systemStatusResp, nil
+}
+
+type GridStatus struct {
+	GridServicesActive bool `json:"grid_services_active"`
+}
+
+func (c *TeslaClient) GetGridStatus() (*GridStatus, error) {
+	var gridStatusResp GridStatus
+	err := getAPI(c, "/api/system_status/grid_status", &gridStatusResp,
+		func() {
+			var val float64 = 0
+			if gridStatusResp.GridServicesActive {
+				val = 1
+			}
+			c.gridServicesEnabledGauge.WithLabelValues("powerwall").Set(val)
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	return &gridStatusResp, nil
+}
+
+type OperationMode int
+
+const (
+	OperationUnknown OperationMode = iota
+	OperationSelfConsumption
+	OperationAutonomous
+	OperationBackup
+)
+
+func (o OperationMode) String() string {
+	switch o {
+	case OperationSelfConsumption:
+		return "self-consumption"
+	case OperationBackup:
+		return "backup"
+	case OperationAutonomous:
+		return "autonomous"
+	default:
+		return "unknown"
+	}
+}
+
+// apiName is the mode's name in /api/operation.
+func (o OperationMode) apiName() string {
+	switch o {
+	case OperationSelfConsumption:
+		return "self_consumption"
+	case OperationBackup:
+		return "backup"
+	case OperationAutonomous:
+		return "autonomous"
+	default:
+		return ""
+	}
+}
+
+func ParseOperationMode(s string) (OperationMode, error) {
+	for _, o := range []OperationMode{OperationSelfConsumption, OperationAutonomous, OperationBackup} {
+		if s == o.apiName() {
+			return o, nil
+		}
+	}
+	return OperationUnknown, fmt.Errorf("unknown operation mode %q (expected self_consumption, autonomous or backup)", s)
+}
+
+func (o *OperationMode) UnmarshalJSON(b []byte) error {
+	str := strings.Trim(string(b), `"`)
+
+	switch str {
+	case "autonomous":
+		*o = OperationAutonomous
+	case "self_consumption":
+		*o = OperationSelfConsumption
+	case "backup":
+		*o = OperationBackup
+	default:
+		// New firmware has introduced modes before. Don't fail the whole poll
+		// over a value that's only informational.
+		log.Printf("Warning: unknown operation mode %q", str)
+		*o = OperationUnknown
+	}
+
+	return nil
+}
+
+type Operation struct {
+	BackupReservePercent float64       `json:"backup_reserve_percent"`
+	Mode                 OperationMode `json:"real_mode"`
+}
+
+func (c *TeslaClient) GetOperation() (*Operation, error) {
+	var operation Operation
+	err := getAPI(c, "/api/operation", &operation,
+		func() {
+			c.batteryLevelGauge.WithLabelValues("powerwall-reserve").Set(operation.BackupReservePercent)
+		},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	return &operation, nil
+}
+
+// SetOperation changes the operation mode and backup reserve. The gateway
+// only applies the change once /api/config/completed is requested.
+func (c *TeslaClient) SetOperation(mode OperationMode, backupReservePercent float64) error {
+	if mode.apiName() == "" {
+		return fmt.Errorf("can't set operation mode %s", mode)
+	}
+
+	req := struct {
+		Mode                 string  `json:"real_mode"`
+		BackupReservePercent float64 `json:"backup_reserve_percent"`
+	}{
+		Mode:                 mode.apiName(),
+		BackupReservePercent: backupReservePercent,
+	}
+	if err := postAPI(c, "/api/operation", req); err != nil {
+		return err
+	}
+
+	return getAPI(c, "/api/config/completed", &json.RawMessage{}, func() {})
+}
+
+// SetBackupReserve changes the backup reserve, keeping the operation mode.
+func (c *TeslaClient) SetBackupReserve(percent float64) error {
+	op, err := c.GetOperation()
+	if err != nil {
+		return err
+	}
+	return c.SetOperation(op.Mode, percent)
+}
+
+// SetOperationMode changes the operation mode, keeping the backup reserve.
+func (c *TeslaClient) SetOperationMode(mode OperationMode) error {
+	op, err := c.GetOperation()
+	if err != nil {
+		return err
+	}
+	return c.SetOperation(mode, op.BackupReservePercent)
+}
@@ -0,0 +1,603 @@
+package powerwall
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testPassword = "hunter2"
+
+// fakeGateway serves the parts of the gateway's API the client uses. Every
+// endpoint except login needs the session cookie login sets.
+type fakeGateway struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	session   string            // Current valid session cookie
+	sessions  int               // Logins so far
+	responses map[string]string // Body by path
+	posted    map[string][]byte // Last request body by path
+	encoding  map[string]string // Content-Encoding by path: "gzip" or "deflate"
+
+	// failPost, if set, is asked about every POST. Those it returns true
+	// for fail without changing anything.
+	failPost func(path string, body []byte) bool
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	g := &fakeGateway{
+		responses: make(map[string]string),
+		posted:    make(map[string][]byte),
+		encoding:  make(map[string]string),
+	}
+	g.Server = httptest.NewTLSServer(http.HandlerFunc(g.serve))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakeGateway) serve(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if r.Method == http.MethodPost {
+		body, _ := io.ReadAll(r.Body)
+		if g.failPost != nil && g.failPost(r.URL.Path, body) {
+			http.Error(w, `{"error":"busy"}`, http.StatusInternalServerError)
+			return
+		}
+		g.posted[r.URL.Path] = body
+		if r.URL.Path == "/api/operation" {
+			// Later reads see the new settings.
+			g.responses[r.URL.Path] = string(body)
+		}
+	}
+
+	if r.URL.Path == "/api/login/Basic" {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.Unmarshal(g.posted[r.URL.Path], &req); err != nil || req.Password != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"code":401,"error":"bad credentials","message":"Login Error"}`))
+			return
+		}
+		g.sessions++
+		g.session = strings.Repeat("s", g.sessions)
+		http.SetCookie(w, &http.Cookie{Name: "AuthCookie", Value: g.session, Path: "/"})
+		_, _ = w.Write([]byte(`{"token":"x"}`))
+		return
+	}
+
+	if cookie, err := r.Cookie("AuthCookie"); err != nil || cookie.Value != g.session {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"code":401,"error":"bad credentials"}`))
+		return
+	}
+
+	body, ok := g.responses[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch g.encoding[r.URL.Path] {
+	case "gzip":
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte(body))
+		_ = gz.Close()
+	case "deflate":
+		w.Header().Set("Content-Encoding", "deflate")
+		zw := zlib.NewWriter(w)
+		_, _ = zw.Write([]byte(body))
+		_ = zw.Close()
+	default:
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func (g *fakeGateway) respond(path, body string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.responses[path] = body
+}
+
+func (g *fakeGateway) postedBody(path string) []byte {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.posted[path]
+}
+
+// expireSessions makes the gateway reject the current session, like it does
+// after a restart.
+func (g *fakeGateway) expireSessions() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.session = "expired"
+}
+
+type testGauges struct {
+	batteryLevel, energyExported, energyImported, energyLevels, power, gridServicesEnabled *prometheus.GaugeVec
+}
+
+func newTestGauges() testGauges {
+	gauge := func(name string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name}, []string{"meter"})
+	}
+	return testGauges{
+		batteryLevel:        gauge("battery_level"),
+		energyExported:      gauge("energy_exported"),
+		energyImported:      gauge("energy_imported"),
+		energyLevels:        gauge("energy_levels"),
+		power:               gauge("power"),
+		gridServicesEnabled: gauge("grid_services_enabled"),
+	}
+}
+
+func newTestClient(t *testing.T, g *fakeGateway, password string) (*TeslaClient, testGauges) {
+	t.Helper()
+	gauges := newTestGauges()
+	c := NewTEGClient(g.Listener.Addr().String(), password, false,
+		gauges.batteryLevel, gauges.energyExported, gauges.energyImported, gauges.energyLevels, gauges.power, gauges.gridServicesEnabled)
+	return c, gauges
+}
+
+func loggedInClient(t *testing.T, g *fakeGateway) (*TeslaClient, testGauges) {
+	t.Helper()
+	c, gauges := newTestClient(t, g, testPassword)
+	if err := c.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return c, gauges
+}
+
+func TestLogin(t *testing.T) {
+	g := newFakeGateway(t)
+	c, _ := newTestClient(t, g, testPassword)
+	if err := c.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	var req map[string]interface{}
+	if err := json.Unmarshal(g.postedBody("/api/login/Basic"), &req); err != nil {
+		t.Fatalf("decoding login request: %v", err)
+	}
+	if req["username"] != DefaultTeslaUsername || req["email"] != DefaultTeslaEmail || req["password"] != testPassword {
+		t.Errorf("login request = %v", req)
+	}
+}
+
+func TestLoginBadPassword(t *testing.T) {
+	g := newFakeGateway(t)
+	c, _ := newTestClient(t, g, "wrong")
+	err := c.Login()
+	if !IsAuthError(err) {
+		t.Fatalf("Login = %v, want an auth error", err)
+	}
+	if !strings.Contains(err.Error(), "Login Error") {
+		t.Errorf("error %q doesn't include the response body", err)
+	}
+}
+
+func TestGetAPIReloginAfter401(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/system_status/soe", `{"percentage":55}`)
+	c, _ := loggedInClient(t, g)
+
+	if _, err := c.GetStateOfEnergy(); err != nil {
+		t.Fatalf("GetStateOfEnergy: %v", err)
+	}
+
+	g.expireSessions()
+	_, err := c.GetStateOfEnergy()
+	if !IsAuthError(err) {
+		t.Fatalf("GetStateOfEnergy with an expired session = %v, want an auth error", err)
+	}
+
+	// What the poll loop does on an auth error.
+	if err := c.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	soe, err := c.GetStateOfEnergy()
+	if err != nil {
+		t.Fatalf("GetStateOfEnergy after logging in again: %v", err)
+	}
+	if soe.Percentage != 55 {
+		t.Errorf("Percentage = %v, want 55", soe.Percentage)
+	}
+}
+
+func TestGetAPINotFound(t *testing.T) {
+	g := newFakeGateway(t)
+	c, _ := loggedInClient(t, g)
+
+	_, err := c.GetSystemStatus()
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Path != "/api/system_status" {
+		t.Fatalf("GetSystemStatus = %v, want a 404 APIError for /api/system_status", err)
+	}
+	if IsAuthError(err) {
+		t.Errorf("IsAuthError(%v) = true", err)
+	}
+}
+
+func TestGetAPIBadJSON(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/system_status/soe", `{"percentage":`)
+	c, gauges := loggedInClient(t, g)
+
+	if _, err := c.GetStateOfEnergy(); err == nil || !strings.Contains(err.Error(), "/api/system_status/soe") {
+		t.Fatalf("GetStateOfEnergy = %v, want a decoding error naming the path", err)
+	}
+	if n := testutil.CollectAndCount(gauges.batteryLevel); n != 0 {
+		t.Errorf("%d battery level gauges set from a bad response", n)
+	}
+}
+
+func TestGetAPICompressed(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			g := newFakeGateway(t)
+			g.respond("/api/operation", `{"real_mode":"self_consumption","backup_reserve_percent":20}`)
+			g.encoding["/api/operation"] = encoding
+			c, _ := loggedInClient(t, g)
+
+			op, err := c.GetOperation()
+			if err != nil {
+				t.Fatalf("GetOperation: %v", err)
+			}
+			if op.Mode != OperationSelfConsumption || op.BackupReservePercent != 20 {
+				t.Errorf("GetOperation = %+v", op)
+			}
+		})
+	}
+}
+
+// The transport only decompresses gzip it asked for. Gateways behind some
+// proxies send it regardless.
+func TestReadBodyUnrequestedGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write([]byte(`{"percentage":42}`))
+	_ = gz.Close()
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{"GZIP"}},
+		Body:   io.NopCloser(&buf),
+	}
+	body, err := readBody(resp, DefaultMaxBodyBytes)
+	if err != nil {
+		t.Fatalf("readBody: %v", err)
+	}
+	if string(body) != `{"percentage":42}` {
+		t.Errorf("readBody = %q", body)
+	}
+}
+
+func TestReadBodyTooLarge(t *testing.T) {
+	for _, tc := range []struct {
+		size    int
+		wantErr bool
+	}{
+		{size: 99},
+		{size: 100},
+		{size: 101, wantErr: true},
+		{size: 10000, wantErr: true},
+	} {
+		resp := &http.Response{Body: io.NopCloser(strings.NewReader(strings.Repeat("x", tc.size)))}
+		body, err := readBody(resp, 100)
+		if tc.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "larger than 100 bytes") {
+				t.Errorf("readBody(%d bytes) = %v, want a too large error", tc.size, err)
+			}
+			continue
+		}
+		if err != nil || len(body) != tc.size {
+			t.Errorf("readBody(%d bytes) = %d bytes, %v", tc.size, len(body), err)
+		}
+	}
+}
+
+func TestGetAPIOversizedResponse(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/status", `{"din":"`+strings.Repeat("1", 1000)+`"}`)
+	// Compressed, it's well under the limit. Decompressed, it isn't.
+	g.encoding["/api/status"] = "gzip"
+	c, _ := loggedInClient(t, g)
+	c.MaxBodyBytes = 512
+
+	_, err := c.GetGatewayStatus()
+	if err == nil || !strings.Contains(err.Error(), "larger than 512 bytes") {
+		t.Fatalf("GetGatewayStatus = %v, want a too large error", err)
+	}
+	if _, ok := c.LastPayloads()["/api/status"]; ok {
+		t.Errorf("oversized response recorded in LastPayloads")
+	}
+}
+
+func TestGetMeterAggregates(t *testing.T) {
+	const resp = `{
+		"site": {"instant_power": -1200, "energy_exported": 5000, "energy_imported": 7000, "i_a_current": 10.5, "i_b_current": 3, "i_c_current": 0},
+		"solar": {"instant_power": 4000, "energy_exported": 9000, "energy_imported": 10},
+		"busway": {"instant_power": 0}
+	}`
+	g := newFakeGateway(t)
+	g.respond("/api/meters/aggregates", resp)
+	c, gauges := loggedInClient(t, g)
+	c.DisabledMeters = map[string]bool{"busway": true}
+
+	meters, raw, err := c.GetMeterAggregatesRaw()
+	if err != nil {
+		t.Fatalf("GetMeterAggregatesRaw: %v", err)
+	}
+	if string(raw) != resp {
+		t.Errorf("raw = %q, want the response verbatim", raw)
+	}
+	site := meters["site"]
+	if site.InstantPower != -1200 || site.CurrentA != 10.5 || site.CurrentB != 3 || site.CurrentC != 0 {
+		t.Errorf("site = %+v", site)
+	}
+	if meters["solar"].InstantPower != 4000 {
+		t.Errorf("solar = %+v", meters["solar"])
+	}
+
+	for _, tc := range []struct {
+		gauge *prometheus.GaugeVec
+		meter string
+		want  float64
+	}{
+		{gauges.power, "site", -1200},
+		{gauges.power, "solar", 4000},
+		{gauges.energyExported, "site", 5000},
+		{gauges.energyImported, "site", 7000},
+		{gauges.energyExported, "solar", 9000},
+	} {
+		if got := testutil.ToFloat64(tc.gauge.WithLabelValues(tc.meter)); got != tc.want {
+			t.Errorf("%s gauge = %v, want %v", tc.meter, got, tc.want)
+		}
+	}
+	if n := testutil.CollectAndCount(gauges.power); n != 2 {
+		t.Errorf("%d power gauges, want 2 (busway is disabled)", n)
+	}
+
+	if got := string(c.LastPayloads()["/api/meters/aggregates"]); got != resp {
+		t.Errorf("LastPayloads = %q", got)
+	}
+}
+
+func TestGetStateOfEnergy(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/system_status/soe", `{"percentage":81.5}`)
+	c, gauges := loggedInClient(t, g)
+
+	soe, err := c.GetStateOfEnergy()
+	if err != nil {
+		t.Fatalf("GetStateOfEnergy: %v", err)
+	}
+	if soe.Percentage != 81.5 {
+		t.Errorf("Percentage = %v, want 81.5", soe.Percentage)
+	}
+	if got := testutil.ToFloat64(gauges.batteryLevel.WithLabelValues("powerwall")); got != 81.5 {
+		t.Errorf("battery level gauge = %v, want 81.5", got)
+	}
+}
+
+// A gateway that is restarting briefly reports 0%.
+func TestGetStateOfEnergyTransientZero(t *testing.T) {
+	g := newFakeGateway(t)
+	c, gauges := loggedInClient(t, g)
+
+	for i, tc := range []struct {
+		reported float64
+		want     float64
+	}{
+		{50, 50},
+		{0, 50},
+		{0, 50},
+		{51, 51},
+		// Once it persists, it's believed.
+		{0, 51},
+		{0, 51},
+		{0, 0},
+		{52, 52},
+	} {
+		g.respond("/api/system_status/soe", `{"percentage":`+strconv.FormatFloat(tc.reported, 'f', -1, 64)+`}`)
+		soe, err := c.GetStateOfEnergy()
+		if err != nil {
+			t.Fatalf("read %d: GetStateOfEnergy: %v", i, err)
+		}
+		if soe.Percentage != tc.want {
+			t.Errorf("read %d: reported %v, got %v, want %v", i, tc.reported, soe.Percentage, tc.want)
+		}
+		if got := testutil.ToFloat64(gauges.batteryLevel.WithLabelValues("powerwall")); got != tc.want {
+			t.Errorf("read %d: battery level gauge = %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestGetStateOfEnergyImplausibleFirstRead(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/system_status/soe", `{"percentage":0}`)
+	c, gauges := loggedInClient(t, g)
+
+	if _, err := c.GetStateOfEnergy(); !errors.Is(err, ErrImplausibleSOE) {
+		t.Fatalf("GetStateOfEnergy with no good reading yet = %v, want ErrImplausibleSOE", err)
+	}
+	if n := testutil.CollectAndCount(gauges.batteryLevel); n != 0 {
+		t.Errorf("%d battery level gauges set from an implausible reading", n)
+	}
+
+	// Any other failure is still an error the poll loop has to handle.
+	g.respond("/api/system_status/soe", `{"percentage":`)
+	if _, err := c.GetStateOfEnergy(); err == nil || errors.Is(err, ErrImplausibleSOE) {
+		t.Fatalf("GetStateOfEnergy with a bad response = %v, want a decoding error", err)
+	}
+}
+
+func TestGetGatewayStatus(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/status", `{"din":"1152100-13-J--TG1","version":"23.12.10 30f95d1b","git_hash":"30f95d1b","device_type":"teg","up_time_seconds":"62h26m41.46s"}`)
+	c, _ := loggedInClient(t, g)
+
+	status, err := c.GetGatewayStatus()
+	if err != nil {
+		t.Fatalf("GetGatewayStatus: %v", err)
+	}
+	if status.DIN != "1152100-13-J--TG1" || status.Version != "23.12.10 30f95d1b" || status.DeviceType != "teg" {
+		t.Errorf("GetGatewayStatus = %+v", status)
+	}
+	uptime, err := status.Uptime()
+	if err != nil {
+		t.Fatalf("Uptime: %v", err)
+	}
+	if uptime.Hours() < 62 || uptime.Hours() > 63 {
+		t.Errorf("Uptime = %s", uptime)
+	}
+}
+
+func TestGetSystemStatus(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/system_status", `{"nominal_full_pack_energy":13500,"nominal_energy_remaining":6750}`)
+	c, gauges := loggedInClient(t, g)
+
+	status, err := c.GetSystemStatus()
+	if err != nil {
+		t.Fatalf("GetSystemStatus: %v", err)
+	}
+	if status.NominalFullPackEnergyWh != 13500 || status.NominalEnergyRemainingWh != 6750 {
+		t.Errorf("GetSystemStatus = %+v", status)
+	}
+	if got := testutil.ToFloat64(gauges.energyLevels.WithLabelValues("nominal-full-pack")); got != 13500 {
+		t.Errorf("full pack gauge = %v, want 13500", got)
+	}
+	if got := testutil.ToFloat64(gauges.energyLevels.WithLabelValues("nominal-energy-remaning")); got != 6750 {
+		t.Errorf("remaining gauge = %v, want 6750", got)
+	}
+}
+
+func TestGetGridStatus(t *testing.T) {
+	g := newFakeGateway(t)
+	c, gauges := loggedInClient(t, g)
+
+	for _, active := range []bool{true, false} {
+		g.respond("/api/system_status/grid_status", `{"grid_status":"SystemGridConnected","grid_services_active":`+strconv.FormatBool(active)+`}`)
+		status, err := c.GetGridStatus()
+		if err != nil {
+			t.Fatalf("GetGridStatus: %v", err)
+		}
+		if status.GridServicesActive != active {
+			t.Errorf("GridServicesActive = %v, want %v", status.GridServicesActive, active)
+		}
+
+		want := 0.0
+		if active {
+			want = 1
+		}
+		if got := testutil.ToFloat64(gauges.gridServicesEnabled.WithLabelValues("powerwall")); got != want {
+			t.Errorf("grid services gauge = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGetOperation(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/operation", `{"real_mode":"autonomous","backup_reserve_percent":35}`)
+	c, gauges := loggedInClient(t, g)
+
+	op, err := c.GetOperation()
+	if err != nil {
+		t.Fatalf("GetOperation: %v", err)
+	}
+	if op.Mode != OperationAutonomous || op.BackupReservePercent != 35 {
+		t.Errorf("GetOperation = %+v", op)
+	}
+	if got := testutil.ToFloat64(gauges.batteryLevel.WithLabelValues("powerwall-reserve")); got != 35 {
+		t.Errorf("reserve gauge = %v, want 35", got)
+	}
+}
+
+func TestSetBackupReserve(t *testing.T) {
+	g := newFakeGateway(t)
+	g.respond("/api/operation", `{"real_mode":"self_consumption","backup_reserve_percent":20}`)
+	g.respond("/api/config/completed", `{}`)
+	c, _ := loggedInClient(t, g)
+
+	if err := c.SetBackupReserve(80); err != nil {
+		t.Fatalf("SetBackupReserve: %v", err)
+	}
+
+	var req struct {
+		Mode                 string  `json:"real_mode"`
+		BackupReservePercent float64 `json:"backup_reserve_percent"`
+	}
+	if err := json.Unmarshal(g.postedBody("/api/operation"), &req); err != nil {
+		t.Fatalf("decoding request: %v", err)
+	}
+	if req.Mode != "self_consumption" || req.BackupReservePercent != 80 {
+		t.Errorf("posted %+v, want the mode kept and an 80%% reserve", req)
+	}
+}
+
+func TestSetOperationUnknownMode(t *testing.T) {
+	g := newFakeGateway(t)
+	c, _ := loggedInClient(t, g)
+
+	if err := c.SetOperation(OperationUnknown, 20); err == nil {
+		t.Fatalf("SetOperation(OperationUnknown) succeeded")
+	}
+	if g.postedBody("/api/operation") != nil {
+		t.Errorf("unknown mode was posted to the gateway")
+	}
+}
+
+func TestOperationModeUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want OperationMode
+	}{
+		{`"self_consumption"`, OperationSelfConsumption},
+		{`"autonomous"`, OperationAutonomous},
+		{`"backup"`, OperationBackup},
+		// Modes added by new firmware must not fail the poll.
+		{`"grid_charging_only"`, OperationUnknown},
+		{`""`, OperationUnknown},
+	} {
+		var op Operation
+		if err := json.Unmarshal([]byte(`{"real_mode":`+tc.json+`,"backup_reserve_percent":10}`), &op); err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+			continue
+		}
+		if op.Mode != tc.want {
+			t.Errorf("%s: Mode = %s, want %s", tc.json, op.Mode, tc.want)
+		}
+		if op.BackupReservePercent != 10 {
+			t.Errorf("%s: BackupReservePercent = %v, want the rest to still decode", tc.json, op.BackupReservePercent)
+		}
+	}
+}
+
+func TestParseOperationMode(t *testing.T) {
+	for _, mode := range []OperationMode{OperationSelfConsumption, OperationAutonomous, OperationBackup} {
+		got, err := ParseOperationMode(mode.apiName())
+		if err != nil || got != mode {
+			t.Errorf("ParseOperationMode(%q) = %s, %v", mode.apiName(), got, err)
+		}
+	}
+	if _, err := ParseOperationMode("self-consumption"); err == nil {
+		t.Errorf("ParseOperationMode accepted the display name")
+	}
+}
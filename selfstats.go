@@ -0,0 +1,53 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfCollector reports the exporter's own health: whether the last poll
+// cycle succeeded, how long it took and how many goroutines are running.
+type selfCollector struct {
+	upDesc         *prometheus.Desc
+	goroutinesDesc *prometheus.Desc
+	cycleDesc      *prometheus.Desc
+
+	up            atomic.Bool
+	lastCycleNano atomic.Int64
+}
+
+func newSelfCollector(namespace string) *selfCollector {
+	return &selfCollector{
+		upDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "up"),
+			"1 if the last poll cycle succeeded", nil, nil),
+		goroutinesDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "goroutines"),
+			"Number of goroutines in the exporter", nil, nil),
+		cycleDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "last_cycle_duration_seconds"),
+			"Duration of the last poll cycle", nil, nil),
+	}
+}
+
+// recordCycle is called at the end of every poll cycle.
+func (c *selfCollector) recordCycle(d time.Duration, ok bool) {
+	c.lastCycleNano.Store(int64(d))
+	c.up.Store(ok)
+}
+
+func (c *selfCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.goroutinesDesc
+	ch <- c.cycleDesc
+}
+
+func (c *selfCollector) Collect(ch chan<- prometheus.Metric) {
+	var up float64
+	if c.up.Load() {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(c.goroutinesDesc, prometheus.GaugeValue, float64(runtime.NumGoroutine()))
+	ch <- prometheus.MustNewConstMetric(c.cycleDesc, prometheus.GaugeValue, time.Duration(c.lastCycleNano.Load()).Seconds())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/anupcshan/powerwall2mqtt/powerwall"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// selfTest checks that the gateway and the MQTT broker are reachable with the
+// configured credentials, through the same calls the daemon makes.
+type selfTest struct {
+	w      io.Writer
+	failed bool
+}
+
+// check runs fn and prints a PASS or FAIL line for it.
+func (s *selfTest) check(name string, fn func() (string, error)) bool {
+	detail, err := fn()
+	if err != nil {
+		s.failed = true
+		fmt.Fprintf(s.w, "FAIL  %s: %v\n", name, err)
+		return false
+	}
+	if detail != "" {
+		fmt.Fprintf(s.w, "PASS  %s: %s\n", name, detail)
+	} else {
+		fmt.Fprintf(s.w, "PASS  %s\n", name)
+	}
+	return true
+}
+
+func (s *selfTest) skip(name, reason string) {
+	fmt.Fprintf(s.w, "SKIP  %s: %s\n", name, reason)
+}
+
+// runSelfTest logs in to the gateway and polls it once, then connects to the
+// broker and publishes a message to <topic>/selftest. It reports whether
+// every check passed.
+func runSelfTest(w io.Writer, teslaClient *powerwall.TeslaClient, brokerURL string, connectTimeout time.Duration, topic string) bool {
+	s := &selfTest{w: w}
+
+	if s.check("Tesla login", func() (string, error) {
+		return "", teslaClient.Login()
+	}) {
+		s.check("Tesla gateway status", func() (string, error) {
+			status, err := teslaClient.GetGatewayStatus()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s firmware %s", status.DeviceType, status.Version), nil
+		})
+		s.check("Tesla meters", func() (string, error) {
+			meters, err := teslaClient.GetMeterAggregates()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("solar %.0f W, load %.0f W, grid %.0f W",
+				meters["solar"].InstantPower, meters["load"].InstantPower, meters["site"].InstantPower), nil
+		})
+		s.check("Tesla battery level", func() (string, error) {
+			soe, err := teslaClient.GetStateOfEnergy()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%.1f%%", soe.Percentage), nil
+		})
+		s.check("Tesla operation mode", func() (string, error) {
+			op, err := teslaClient.GetOperation()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %.0f%% reserve", op.Mode, op.BackupReservePercent), nil
+		})
+	} else {
+		s.skip("Tesla poll", "login failed")
+	}
+
+	client := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker(brokerURL).
+		SetConnectTimeout(connectTimeout))
+	if s.check("MQTT connect", func() (string, error) {
+		token := client.Connect()
+		if !token.WaitTimeout(connectTimeout) {
+			return "", fmt.Errorf("timed out after %s", connectTimeout)
+		}
+		return brokerURL, token.Error()
+	}) {
+		s.check("MQTT publish", func() (string, error) {
+			selfTestTopic := fmt.Sprintf("%s/selftest", topic)
+			token := client.Publish(selfTestTopic, 1, false, time.Now().Format(time.RFC3339))
+			if !token.WaitTimeout(connectTimeout) {
+				return "", fmt.Errorf("timed out after %s", connectTimeout)
+			}
+			return selfTestTopic, token.Error()
+		})
+		client.Disconnect(250)
+	} else {
+		s.skip("MQTT publish", "connect failed")
+	}
+
+	if s.failed {
+		fmt.Fprintln(w, "Self test FAILED")
+	} else {
+		fmt.Fprintln(w, "Self test passed")
+	}
+	return !s.failed
+}
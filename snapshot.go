@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anupcshan/powerwall2mqtt/powerwall"
+)
+
+// stateSnapshot is an immutable view of everything shown on the dashboard.
+// HTTP handlers read it without taking the controller lock.
+type stateSnapshot struct {
+	powerwall.ControllerState
+	BudgetW      int32
+	Strategy     string
+	Reason       string // Why BudgetW was chosen
+	BatteryState powerwall.BatteryState
+	UpdatedAt    time.Time
+}
+
+type snapshotStore struct {
+	writeLock sync.Mutex // Serializes writers. Readers never block.
+	current   atomic.Pointer[stateSnapshot]
+}
+
+func newSnapshotStore() *snapshotStore {
+	s := &snapshotStore{}
+	s.current.Store(&stateSnapshot{})
+	return s
+}
+
+func (s *snapshotStore) Load() *stateSnapshot {
+	return s.current.Load()
+}
+
+// update stores a modified copy of the current snapshot.
+func (s *snapshotStore) update(f func(*stateSnapshot)) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	next := *s.current.Load()
+	f(&next)
+	s.current.Store(&next)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// httpServer holds the TLS settings shared by the web UI and metrics
+// listeners. If certFile is set they serve HTTPS, and if clientCAFile is set
+// too, clients must present a certificate signed by one of the CAs in it.
+type httpServer struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+}
+
+func (s httpServer) listenAndServe(addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if s.certFile == "" {
+		return srv.ListenAndServe()
+	}
+
+	srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.clientCAFile != "" {
+		pem, err := os.ReadFile(s.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + s.clientCAFile)
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return srv.ListenAndServeTLS(s.certFile, s.keyFile)
+}
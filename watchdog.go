@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// watchdog exits the process if the poll loop stops petting it, so that a
+// supervisor restarts a wedged process instead of leaving it idle.
+type watchdog struct {
+	timeout time.Duration
+	lastPet atomic.Int64 // Unix nanoseconds
+}
+
+func newWatchdog(timeout time.Duration) *watchdog {
+	w := &watchdog{timeout: timeout}
+	w.pet()
+	return w
+}
+
+// pet is called at the end of every poll cycle.
+func (w *watchdog) pet() {
+	w.lastPet.Store(time.Now().UnixNano())
+}
+
+func (w *watchdog) run() {
+	ticker := time.NewTicker(w.timeout / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		since := time.Since(time.Unix(0, w.lastPet.Load()))
+		if since < w.timeout {
+			continue
+		}
+
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		log.Printf("Poll loop stalled for %s, exiting. Goroutines:\n%s", since.Round(time.Second), buf)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anupcshan/powerwall2mqtt/powerwall"
+)
+
+const (
+	indexTmpl = `
+<!DOCTYPE html>
+<html>
+<head>
+	<script src="/assets/htmx.org@1.9.12/dist/htmx.min.js"></script>
+	<script src="/assets/htmx.org@1.9.12/dist/ext/sse.js"></script>
+	<style>
+	table, th, td {
+		border: 1px solid black;
+		border-collapse: collapse;
+		padding: 5px;
+		text-align: center;
+	}
+	</style>
+</head>
+<body>
+	<div hx-ext="sse" sse-connect="/events">
+		<div>Last updated: <span sse-swap="last-updated">Never</span></div><br/>
+		<table>
+			<tr>
+				<th>Solar</th>
+				<th>Load</th>
+				<th>Grid</th>
+				<th>Powerwall Level</th>
+				<th>Powerwall State</th>
+				<th>Operation Mode</th>
+			</tr>
+			<tr>
+				<td sse-swap="solar">Pending</td>
+				<td sse-swap="load">Pending</td>
+				<td sse-swap="site">Pending</td>
+				<td sse-swap="powerwall-batt-level">Pending</td>
+				<td sse-swap="powerwall-batt-state">Pending</td>
+				<td sse-swap="powerwall-oper-mode">Pending</td>
+			</tr>
+		</table>
+
+		<br/>
+
+		<div><b>EVSE:</b></div><br/>
+
+		<table>
+			<tr>
+				<th>Temp</th>
+				<th>Current</th>
+				<th>Power Budget</th>
+				<th>Strategy</th>
+				<th>Reason</th>
+				<th>EV</th>
+			</tr>
+			<tr>
+				<td sse-swap="evse-temp">Pending</td>
+				<td sse-swap="evse-current">Pending</td>
+				<td sse-swap="evse-budget">Pending</td>
+				<td sse-swap="evse-strategy">Pending</td>
+				<td sse-swap="evse-reason">Pending</td>
+				<td sse-swap="ev-connected">Pending</td>
+			</tr>
+		</table>
+	</div>
+</body>
+</html>
+`
+)
+
+var configTmpl = template.Must(template.New("config").Funcs(template.FuncMap{
+	"hhmm": func(minute int64) string { return fmt.Sprintf("%02d:%02d", minute/60, minute%60) },
+}).Parse(`
+<!DOCTYPE html>
+<html>
+<body>
+	<form method="POST" action="/config">
+		<table>
+			<tr><td>Peak rates start</td><td><input name="peak_start" value="{{hhmm .PeakStartMinute}}"/></td></tr>
+			<tr><td>Peak rates end</td><td><input name="peak_end" value="{{hhmm .PeakEndMinute}}"/></td></tr>
+			<tr><td>Battery target (%)</td><td><input name="battery_target" value="{{.BatteryTargetPercent}}"/></td></tr>
+			<tr><td>Battery target hysteresis (%)</td><td><input name="battery_hysteresis" value="{{.BatteryTargetHysteresis}}"/></td></tr>
+			<tr><td>Solar floor (W)</td><td><input name="solar_floor_w" value="{{.SolarFloorW}}"/></td></tr>
+			<tr><td>Baseline load (W)</td><td><input name="baseline_load_w" value="{{.BaselineLoadW}}"/></td></tr>
+		</table>
+		<input type="submit" value="Apply"/>
+	</form>
+</body>
+</html>
+`))
+
+//go:embed assets
+var assets embed.FS
+
+// assetHandler serves the embedded assets. Their paths include the package
+// version (like htmx.org@1.9.12), so a path never changes content and can be
+// cached for good. The embedded files have no modification time, so without
+// this browsers would fetch them again on every page load.
+func assetHandler() http.Handler {
+	files := http.FileServer(http.FS(assets))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fs.Stat(assets, strings.TrimPrefix(r.URL.Path, "/")); err == nil && strings.Contains(r.URL.Path, "@") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			// Including not found, which may be fixed by the next deploy.
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if path.Ext(r.URL.Path) == ".js" {
+			// Don't depend on the system MIME tables being present.
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// registerWebHandlers registers the dashboard and its endpoints on mux.
+func registerWebHandlers(mux *http.ServeMux, snapshots *snapshotStore, triggerPoll func(), logSnapshot func()) {
+	mux.Handle("/assets/", assetHandler())
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, indexTmpl)
+	}))
+
+	mux.Handle("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		dataCache := make(map[string]string)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			snap := snapshots.Load()
+			lastUpdated := "Never"
+			if !snap.UpdatedAt.IsZero() {
+				lastUpdated = snap.UpdatedAt.Format(time.DateTime)
+			}
+			data := map[string]string{
+				"solar":                fmt.Sprintf("%.0f W", snap.SolarW),
+				"load":                 fmt.Sprintf("%.0f W", snap.LoadW),
+				"site":                 fmt.Sprintf("%.0f W", -snap.ExportedSolarW),
+				"powerwall-batt-level": fmt.Sprintf("%.1f%%", snap.PowerwallBatteryLevel),
+				"powerwall-batt-state": string(snap.BatteryState),
+				"powerwall-oper-mode":  snap.OperationMode.String(),
+				"evse-temp":            snap.EVSETemp.String(),
+				"evse-current":         fmt.Sprintf("%.1f A", float64(snap.EVSEMilliAmp)/1000.0),
+				"evse-budget":          fmt.Sprintf("%d W", snap.BudgetW),
+				"evse-strategy":        snap.Strategy,
+				"evse-reason":          snap.Reason,
+				"ev-connected":         snap.EVConnected.String(),
+				"last-updated":         lastUpdated,
+			}
+
+			for k, v := range data {
+				if dataCache[k] == v {
+					continue
+				}
+
+				fmt.Fprintf(w, "event: %s\n", k)
+				fmt.Fprintf(w, "data: %s\n", v)
+				fmt.Fprint(w, "\n\n")
+				dataCache[k] = v
+			}
+
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}))
+	mux.Handle("/api/flow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(computePowerFlow(snapshots.Load())); err != nil {
+			log.Printf("Error writing power flow: %v", err)
+		}
+	}))
+
+	mux.Handle("/poll", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		triggerPoll()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	mux.Handle("/snapshot", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		logSnapshot()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// registerHAPackageHandler registers /ha-package, which serves the Home
+// Assistant package YAML for the entities reporter publishes.
+func registerHAPackageHandler(mux *http.ServeMux, reporter *powerwall.MQTTReporter) {
+	mux.Handle("/ha-package", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		if err := reporter.WriteHAPackage(w); err != nil {
+			log.Printf("Error writing Home Assistant package: %v", err)
+		}
+	}))
+}
+
+// authorized checks HTTP basic auth (any username) against password, and
+// writes an error response if it doesn't match. Requests are refused if no
+// password is configured.
+func authorized(w http.ResponseWriter, r *http.Request, password string) bool {
+	if password == "" {
+		http.Error(w, "disabled without -web-password", http.StatusForbidden)
+		return false
+	}
+	if _, p, ok := r.BasicAuth(); !ok || subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="powerwall2mqtt"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// registerMQTTResetHandler registers /mqtt/reset, which publishes Home
+// Assistant discovery again. With ?values=1, every sensor value is also
+// published again on its next report. Needs HTTP basic auth with password.
+func registerMQTTResetHandler(mux *http.ServeMux, reporter *powerwall.MQTTReporter, password string) {
+	mux.Handle("/mqtt/reset", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(w, r, password) {
+			return
+		}
+
+		clearValues := r.URL.Query().Get("values") == "1"
+		log.Printf("Republishing MQTT discovery from web UI (values: %v)", clearValues)
+		if err := reporter.Republish(clearValues); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// registerConfigHandlers registers /config, which shows the controller's
+// tunable parameters and applies edits posted from its form. Edits need HTTP
+// basic auth with password, and are refused if no password is configured.
+func registerConfigHandlers(mux *http.ServeMux, cont *powerwall.Controller, password string) {
+	mux.Handle("/config", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := configTmpl.Execute(w, cont.Config()); err != nil {
+				log.Printf("Error rendering config page: %v", err)
+			}
+		case http.MethodPost:
+			if !authorized(w, r, password) {
+				return
+			}
+
+			config, err := parseConfigForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Printf("Applying config from web UI: %+v", config)
+			cont.SetPeakWindow(config.PeakStartMinute, config.PeakEndMinute)
+			cont.SetBatteryTarget(config.BatteryTargetPercent, config.BatteryTargetHysteresis)
+			cont.SetSolarFloor(config.SolarFloorW, config.BaselineLoadW)
+			cont.Recompute()
+			http.Redirect(w, r, "/config", http.StatusSeeOther)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func parseConfigForm(r *http.Request) (powerwall.ControllerConfig, error) {
+	var config powerwall.ControllerConfig
+	if err := r.ParseForm(); err != nil {
+		return config, err
+	}
+
+	minute := func(field string) (int64, error) {
+		t, err := time.Parse("15:04", r.PostForm.Get(field))
+		if err != nil {
+			return 0, fmt.Errorf("%s: expected HH:MM", field)
+		}
+		return int64(t.Hour()*60 + t.Minute()), nil
+	}
+
+	number := func(field string, min, max float64) (float64, error) {
+		v, err := strconv.ParseFloat(r.PostForm.Get(field), 64)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("%s: expected a number between %g and %g", field, min, max)
+		}
+		return v, nil
+	}
+
+	var err error
+	if config.PeakStartMinute, err = minute("peak_start"); err != nil {
+		return config, err
+	}
+	if config.PeakEndMinute, err = minute("peak_end"); err != nil {
+		return config, err
+	}
+	if config.PeakStartMinute == config.PeakEndMinute {
+		// An end before the start wraps around midnight, but an empty window
+		// is more likely a typo than a wish to never have peak rates.
+		return config, fmt.Errorf("peak_end: must differ from peak_start")
+	}
+	if config.BatteryTargetPercent, err = number("battery_target", 0, 100); err != nil {
+		return config, err
+	}
+	if config.BatteryTargetHysteresis, err = number("battery_hysteresis", 0, 100); err != nil {
+		return config, err
+	}
+	if config.SolarFloorW, err = number("solar_floor_w", 0, 100000); err != nil {
+		return config, err
+	}
+	if config.BaselineLoadW, err = number("baseline_load_w", 0, 100000); err != nil {
+		return config, err
+	}
+	return config, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAssetHandler(t *testing.T) {
+	for _, tc := range []struct {
+		path             string
+		wantStatus       int
+		wantCacheControl string
+		wantContentType  string
+	}{
+		{"/assets/htmx.org@1.9.12/dist/htmx.min.js", http.StatusOK, "public, max-age=31536000, immutable", "text/javascript; charset=utf-8"},
+		{"/assets/htmx.org@1.9.12/dist/ext/sse.js", http.StatusOK, "public, max-age=31536000, immutable", "text/javascript; charset=utf-8"},
+		{"/assets/htmx.org@1.9.12/dist/missing.js", http.StatusNotFound, "no-cache", ""},
+		{"/assets/", http.StatusOK, "no-cache", "text/html; charset=utf-8"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			assetHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tc.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tc.wantCacheControl)
+			}
+			if got := w.Header().Get("Content-Type"); tc.wantContentType != "" && got != tc.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tc.wantContentType)
+			}
+		})
+	}
+}
+
+// The dashboard must only reference assets that are embedded, or they'd 404.
+func TestIndexAssetsEmbedded(t *testing.T) {
+	refs := regexp.MustCompile(`src="(/assets/[^"]+)"`).FindAllStringSubmatch(indexTmpl, -1)
+	if len(refs) == 0 {
+		t.Fatal("no assets referenced by the dashboard")
+	}
+	for _, ref := range refs {
+		w := httptest.NewRecorder()
+		assetHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, ref[1], nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", ref[1], w.Code)
+		}
+	}
+}
+
+func TestParseConfigForm(t *testing.T) {
+	valid := url.Values{
+		"peak_start":         {"16:00"},
+		"peak_end":           {"21:00"},
+		"battery_target":     {"80"},
+		"battery_hysteresis": {"5"},
+		"solar_floor_w":      {"0"},
+		"baseline_load_w":    {"300"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		field   string
+		value   string
+		wantErr bool
+	}{
+		{"valid", "", "", false},
+		{"peak wraps midnight", "peak_end", "02:00", false},
+		{"empty peak", "peak_end", "16:00", true},
+		{"bad time", "peak_start", "4pm", true},
+		{"target out of range", "battery_target", "101", true},
+		{"not a number", "baseline_load_w", "lots", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{}
+			for k, v := range valid {
+				form[k] = v
+			}
+			if tc.field != "" {
+				form.Set(tc.field, tc.value)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/config", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			config, err := parseConfigForm(r)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseConfigForm error = %v, want error %t", err, tc.wantErr)
+			}
+			if err == nil && (config.PeakStartMinute != 16*60 || config.BaselineLoadW != 300) {
+				t.Errorf("parseConfigForm = %+v", config)
+			}
+		})
+	}
+}